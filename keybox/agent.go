@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The agent keeps derived keys in memory so that the other commands do not
+// ask for the master password every time. It talks JSON, one request and one
+// response per connection, over a unix domain socket only the user can use,
+// see socket.go.
+
+type agentRequest struct {
+	Op   string // get, put or lock
+	Path string
+	Key  []byte
+}
+
+type agentResponse struct {
+	Key   []byte
+	Error string
+}
+
+type keyAgent struct {
+	mu      sync.Mutex
+	keys    map[string][]byte
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func agentSocketPath() (string, error) {
+	if p := os.Getenv("KEYBOX_AGENT_SOCK"); len(p) > 0 {
+		return p, nil
+	}
+	dir, err := socketDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "keybox-agent.sock"), nil
+}
+
+func runAgent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 15*time.Minute, "forget the keys after this idle time")
+	fs.Parse(args)
+
+	path, err := agentSocketPath()
+	if err != nil {
+		exitOnError(fmt.Sprintf("Cannot create the agent socket: %s", err))
+	}
+	if _, err := agentCall(agentRequest{Op: "ping"}); err == nil {
+		exitOnError(fmt.Sprintf("Agent is already running on %s", path))
+	}
+
+	l, err := listenUnix(path)
+	if err != nil {
+		exitOnError(fmt.Sprintf("Cannot listen on %s: %s", path, err))
+	}
+
+	a := &keyAgent{keys: make(map[string][]byte), timeout: *timeout}
+	a.timer = time.AfterFunc(a.timeout, a.wipe)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		a.wipe()
+		l.Close()
+	}()
+
+	fmt.Printf("Agent listening on %s\n", path)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go a.serve(conn)
+	}
+}
+
+func (a *keyAgent) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var req agentRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	var resp agentResponse
+	a.mu.Lock()
+	switch req.Op {
+	case "ping":
+	case "get":
+		if k, found := a.keys[req.Path]; found {
+			resp.Key = k
+			a.timer.Reset(a.timeout)
+		} else {
+			resp.Error = "not found"
+		}
+	case "put":
+		a.keys[req.Path] = req.Key
+		a.timer.Reset(a.timeout)
+	case "lock":
+		a.wipeLocked()
+	default:
+		resp.Error = fmt.Sprintf("unknown op %s", req.Op)
+	}
+	json.NewEncoder(conn).Encode(resp)
+	a.mu.Unlock()
+}
+
+func (a *keyAgent) wipe() {
+	a.mu.Lock()
+	a.wipeLocked()
+	a.mu.Unlock()
+}
+
+func (a *keyAgent) wipeLocked() {
+	for p, k := range a.keys {
+		for i := range k {
+			k[i] = 0
+		}
+		delete(a.keys, p)
+	}
+}
+
+func agentCall(req agentRequest) (*agentResponse, error) {
+	path, err := agentSocketPath()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialUnix(path, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+
+	var resp agentResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Error) > 0 {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+// agentKey returns the key the agent holds for the db file, or nil when no
+// agent is running or it does not know the file.
+func agentKey() []byte {
+	resp, err := agentCall(agentRequest{Op: "get", Path: absPath(dbpath)})
+	if err != nil {
+		return nil
+	}
+	return resp.Key
+}
+
+// agentPutKey hands the key of the db file to the agent, if one is running.
+func agentPutKey(key []byte) {
+	agentCall(agentRequest{Op: "put", Path: absPath(dbpath), Key: key})
+}
+
+func lockAgent() {
+	if _, err := agentCall(agentRequest{Op: "lock"}); err != nil {
+		exitOnError(fmt.Sprintf("Cannot reach the agent: %s", err))
+	}
+}
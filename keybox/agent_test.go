@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeyAgent(t *testing.T) {
+	a := &keyAgent{keys: make(map[string][]byte), timeout: time.Minute}
+	a.timer = time.AfterFunc(a.timeout, a.wipe)
+	defer a.timer.Stop()
+
+	call := func(req agentRequest) agentResponse {
+		client, server := net.Pipe()
+		defer client.Close()
+		go a.serve(server)
+
+		var resp agentResponse
+		json.NewEncoder(client).Encode(req)
+		json.NewDecoder(client).Decode(&resp)
+		return resp
+	}
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	call(agentRequest{Op: "put", Path: "/vault", Key: key})
+	if resp := call(agentRequest{Op: "get", Path: "/vault"}); !bytes.Equal(resp.Key, key) {
+		t.Errorf("get: %+v", resp)
+	}
+	if resp := call(agentRequest{Op: "get", Path: "/other"}); resp.Key != nil || len(resp.Error) == 0 {
+		t.Errorf("get unknown path: %+v", resp)
+	}
+
+	call(agentRequest{Op: "lock"})
+	if resp := call(agentRequest{Op: "get", Path: "/vault"}); resp.Key != nil {
+		t.Errorf("get after lock: %+v", resp)
+	}
+}
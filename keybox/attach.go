@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+)
+
+// Files such as recovery codes, certificates or kubeconfigs are attached to
+// keys. Their content is encrypted with a key of its own and kept in chunks
+// next to the vault, see the vault package, so that large files are never
+// in memory at once.
+
+// attachFile attaches a file to a key, replacing the attachment of the same
+// name. Without a file it lists the attachments of the key.
+func attachFile(args []string) {
+	fs := flag.NewFlagSet("attach", flag.ExitOnError)
+	as := fs.String("as", "", "name of the attachment, the name of the file by default")
+	names := parseInterspersed(fs, args)
+	if len(names) == 0 || len(names) > 2 || len(names) == 2 && names[1] == "-" && len(*as) == 0 {
+		exitOnError("Usage: keybox attach <name> [<file> [-as name]], - for stdin with -as")
+	}
+
+	if len(names) == 1 {
+		loadDBFile()
+		k := mustGetKey(names[0])
+		for _, a := range k.Attachments {
+			fmt.Printf("%-30s %10d  %s\n", a.Name, a.Size, a.Added.Format("2006-01-02"))
+		}
+		return
+	}
+
+	lockDBFile()
+	loadDBFile()
+	k := mustGetKey(names[0])
+
+	name, f := *as, os.Stdin
+	if len(name) == 0 {
+		name = filepath.Base(names[1])
+	}
+	if names[1] != "-" {
+		var err error
+		if f, err = os.Open(names[1]); err != nil {
+			exitOnError(err.Error())
+		}
+		defer f.Close()
+	}
+
+	a, err := db.Attach(name, f)
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	k.Attachments = append([]vault.Attachment(nil), k.Attachments...)
+	if i := attachmentIndex(k, name); i >= 0 {
+		k.Attachments[i] = a
+	} else {
+		k.Attachments = append(k.Attachments, a)
+	}
+	db.Put(k)
+
+	saveDBFile()
+	fmt.Printf("Attached %s to %s, %d bytes\n", name, k.Name, a.Size)
+}
+
+// detachFile writes an attachment of a key to a file, or removes it from
+// the key with -remove.
+func detachFile(args []string) {
+	fs := flag.NewFlagSet("detach", flag.ExitOnError)
+	out := fs.String("o", "", "file to write, - for stdout, the name of the attachment by default")
+	remove := fs.Bool("remove", false, "remove the attachment from the key instead")
+	names := parseInterspersed(fs, args)
+	if len(names) != 2 {
+		exitOnError("Usage: keybox detach <name> <attachment> [-o path | -remove]")
+	}
+
+	if *remove {
+		lockDBFile()
+	}
+	loadDBFile()
+	k := mustGetKey(names[0])
+	i := attachmentIndex(k, names[1])
+	if i < 0 {
+		exitOnError(fmt.Sprintf("Key %s has no attachment %s", k.Name, names[1]))
+	}
+	a := k.Attachments[i]
+
+	if *remove {
+		k.Attachments = append(k.Attachments[:i:i], k.Attachments[i+1:]...)
+		db.Put(k)
+
+		saveDBFile()
+		return
+	}
+
+	if *out == "-" {
+		if err := db.ReadAttachment(a, os.Stdout); err != nil {
+			exitOnError(err.Error())
+		}
+		return
+	}
+
+	path := *out
+	if len(path) == 0 {
+		path = filepath.Base(a.Name)
+	}
+	if _, err := os.Lstat(path); err == nil {
+		exitOnError(fmt.Sprintf("%s exists, pick another file with -o", path))
+	}
+	if err := writeAttachment(a, path); err != nil {
+		exitOnError(fmt.Sprintf("Cannot write %s: %s", path, err))
+	}
+}
+
+// writeAttachment decrypts a to a temporary file renamed to path once
+// complete, so that a tampered attachment leaves nothing behind.
+func writeAttachment(a vault.Attachment, path string) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".keybox-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if err = f.Chmod(0600); err != nil {
+		return err
+	}
+	if err = db.ReadAttachment(a, f); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// copyAttachments copies the attachments of ks from the vault from into db,
+// e.g. when keys are transferred.
+func copyAttachments(ks []key, from *vault.Vault) {
+	for j := range ks {
+		k := &ks[j]
+		k.Attachments = append([]vault.Attachment(nil), k.Attachments...)
+		for i, a := range k.Attachments {
+			c, err := db.CopyAttachment(from, a)
+			if err != nil {
+				exitOnError(fmt.Sprintf("Cannot copy %s of %s: %s", a.Name, k.Name, err))
+			}
+			k.Attachments[i] = c
+		}
+	}
+}
+
+func attachmentIndex(k key, name string) int {
+	for i, a := range k.Attachments {
+		if a.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func mustGetKey(name string) key {
+	k, found := db.Get(name)
+	if !found {
+		exitOnError(fmt.Sprintf("Key %s not found", name))
+	}
+	return k
+}
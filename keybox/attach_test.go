@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+)
+
+func TestWriteAttachment(t *testing.T) {
+	useKeys(t)
+	content := []byte("-----BEGIN CERTIFICATE-----\n")
+	a, err := db.Attach("cert.pem", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cert.pem")
+	if err := writeAttachment(a, path); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(path); !bytes.Equal(got, content) {
+		t.Errorf("got %q, want %q", got, content)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, want 0600", fi.Mode().Perm())
+	}
+
+	a.Key[0] ^= 1
+	broken := filepath.Join(dir, "broken.pem")
+	if err := writeAttachment(a, broken); err != vault.ErrTampered {
+		t.Errorf("tampered: got %v, want ErrTampered", err)
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 1 {
+		t.Errorf("files left behind: %v", names)
+	}
+}
+
+func TestCopyAttachments(t *testing.T) {
+	useKeys(t)
+	a, err := db.Attach("kubeconfig", bytes.NewReader([]byte("apiVersion: v1\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := db
+	ks := []key{{Name: "cluster", Attachments: []vault.Attachment{a}}}
+	original := ks[0].Attachments
+
+	useKeys(t)
+	copyAttachments(ks, source)
+	if ks[0].Attachments[0].ID == a.ID || original[0].ID != a.ID {
+		t.Fatalf("attachment not copied: %+v, source %+v", ks[0].Attachments[0], original[0])
+	}
+	var b bytes.Buffer
+	if err := db.ReadAttachment(ks[0].Attachments[0], &b); err != nil || b.String() != "apiVersion: v1\n" {
+		t.Errorf("copy: %q, %v", b.String(), err)
+	}
+}
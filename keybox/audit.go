@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type auditOptions struct {
+	MinScore int
+	MaxAge   time.Duration // 0 skips the age check
+	HIBP     string        // "" skips the breach check
+}
+
+type weakPassword struct {
+	Name    string
+	Score   int
+	Guesses float64
+}
+
+type oldPassword struct {
+	Name    string
+	Changed time.Time
+}
+
+type breachedPassword struct {
+	Name  string
+	Count int
+}
+
+// auditReport lists the keys with problems. It never holds passwords.
+type auditReport struct {
+	Reused   [][]string
+	Weak     []weakPassword
+	Breached []breachedPassword `json:",omitempty"`
+	// Unchecked are the keys not checked for breaches, their range file is missing
+	Unchecked []string      `json:",omitempty"`
+	Old       []oldPassword `json:",omitempty"`
+	NoURL     []string
+	NoOTP     []string
+}
+
+func (r *auditReport) empty() bool {
+	return len(r.Reused)+len(r.Weak)+len(r.Breached)+len(r.Unchecked)+len(r.Old)+len(r.NoURL)+len(r.NoOTP) == 0
+}
+
+// passwordChanged is when the current password of k was set.
+func passwordChanged(k key) time.Time {
+	if len(k.History) > 0 {
+		return k.History[len(k.History)-1].Changed
+	}
+	return k.Created
+}
+
+// auditKeys checks the keys for reused, weak, breached and old passwords
+// and for missing URLs and OTP secrets. ks are sorted by name.
+func auditKeys(ks []key, opts auditOptions, now time.Time) (*auditReport, error) {
+	r := &auditReport{}
+
+	byPassword := make(map[string][]string)
+	for _, k := range ks {
+		name := k.Name
+		if len(k.Password) > 0 {
+			byPassword[k.Password] = append(byPassword[k.Password], name)
+
+			if g := estimateGuesses(k.Password); strengthScore(g) < opts.MinScore {
+				r.Weak = append(r.Weak, weakPassword{name, strengthScore(g), g})
+			}
+		}
+		if changed := passwordChanged(k); opts.MaxAge > 0 && now.Sub(changed) > opts.MaxAge {
+			r.Old = append(r.Old, oldPassword{name, changed})
+		}
+		if len(k.URL) == 0 {
+			r.NoURL = append(r.NoURL, name)
+		}
+		if k.OTP == nil {
+			r.NoOTP = append(r.NoOTP, name)
+		}
+	}
+
+	for _, shared := range byPassword {
+		if len(shared) > 1 {
+			r.Reused = append(r.Reused, shared)
+		}
+	}
+	sort.Slice(r.Reused, func(i, j int) bool { return r.Reused[i][0] < r.Reused[j][0] })
+
+	if len(opts.HIBP) > 0 {
+		hashes := make(map[string][]string)
+		for password, shared := range byPassword {
+			hashes[passwordHash(password)] = shared
+		}
+		counts, missing, err := breachCounts(opts.HIBP, hashes)
+		if err != nil {
+			return nil, err
+		}
+		for h, count := range counts {
+			for _, name := range hashes[h] {
+				r.Breached = append(r.Breached, breachedPassword{name, count})
+			}
+		}
+		sort.Slice(r.Breached, func(i, j int) bool { return r.Breached[i].Name < r.Breached[j].Name })
+		for _, h := range missing {
+			r.Unchecked = append(r.Unchecked, hashes[h]...)
+		}
+		sort.Strings(r.Unchecked)
+	}
+
+	return r, nil
+}
+
+// passwordHash is the uppercase hex SHA-1 used by Have I Been Pwned.
+func passwordHash(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// breachCounts looks the hashes up offline and returns how often each one
+// that was found has been seen in breaches, and the hashes that could not be
+// looked up as their range file is missing. path is either a directory of
+// HIBP range files, named by the 5 character hash prefix and holding
+// SUFFIX:COUNT lines, or a single file of HASH:COUNT lines.
+func breachCounts(path string, hashes map[string][]string) (map[string]int, []string, error) {
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	counts := make(map[string]int)
+	if !finfo.IsDir() {
+		return counts, nil, scanHashes(path, "", hashes, counts)
+	}
+
+	var missing []string
+	for h := range hashes {
+		prefix := h[:5]
+		name := filepath.Join(path, prefix)
+		if _, err := os.Stat(name); err != nil {
+			name += ".txt"
+		}
+		err := scanHashes(name, prefix, hashes, counts)
+		if os.IsNotExist(err) {
+			missing = append(missing, h)
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("Cannot read the range file for prefix %s: %s", prefix, err)
+		}
+	}
+	return counts, missing, nil
+}
+
+// scanHashes adds the counts of the hashes found in a file of HASH:COUNT
+// lines, where every hash is missing prefix.
+func scanHashes(path, prefix string, hashes map[string][]string, counts map[string]int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		h, count, found := strings.Cut(strings.TrimSpace(s.Text()), ":")
+		if !found {
+			continue
+		}
+		h = prefix + strings.ToUpper(h)
+		if _, wanted := hashes[h]; wanted {
+			n, _ := strconv.Atoi(count)
+			counts[h] = n
+		}
+	}
+	return s.Err()
+}
+
+func auditCmd(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	minScore := fs.Int("min-score", 3, "report passwords scoring below this, from 0 (weakest) to 4")
+	maxAge := fs.String("max-age", "365d", "report passwords older than this, e.g. 365d, 26w or 1y, empty to skip")
+	hibp := fs.String("hibp", "", "directory of Have I Been Pwned range files, or a file of HASH:COUNT lines")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Parse(args)
+
+	opts := auditOptions{MinScore: *minScore, HIBP: *hibp}
+	if len(*maxAge) > 0 {
+		d, err := parseAge(*maxAge)
+		if err != nil {
+			exitOnError(err.Error())
+		}
+		opts.MaxAge = d
+	}
+
+	loadDBFile()
+
+	r, err := auditKeys(db.List(), opts, time.Now())
+	if err != nil {
+		exitOnError(fmt.Sprintf("Audit failed: %s", err))
+	}
+
+	if *asJSON {
+		printJSON(r)
+		return
+	}
+
+	if r.empty() {
+		fmt.Println("No issues found")
+		return
+	}
+	section := func(title string, n int) bool {
+		if n > 0 {
+			fmt.Printf("%s (%d)\n", title, n)
+		}
+		return n > 0
+	}
+	if section("Reused passwords", len(r.Reused)) {
+		for _, shared := range r.Reused {
+			fmt.Printf("  %s\n", strings.Join(shared, ", "))
+		}
+	}
+	if section("Weak passwords", len(r.Weak)) {
+		for _, w := range r.Weak {
+			fmt.Printf("  %-20s score %d, about 10^%.0f guesses\n", w.Name, w.Score, math.Log10(w.Guesses))
+		}
+	}
+	if section("Breached passwords", len(r.Breached)) {
+		for _, b := range r.Breached {
+			fmt.Printf("  %-20s seen %d times\n", b.Name, b.Count)
+		}
+	}
+	if section("Passwords not checked for breaches, their range file is missing", len(r.Unchecked)) {
+		fmt.Printf("  %s\n", strings.Join(r.Unchecked, ", "))
+	}
+	if section(fmt.Sprintf("Passwords older than %s", *maxAge), len(r.Old)) {
+		for _, o := range r.Old {
+			fmt.Printf("  %-20s changed %s\n", o.Name, o.Changed.Format("2006-01-02"))
+		}
+	}
+	if section("Keys without URL", len(r.NoURL)) {
+		fmt.Printf("  %s\n", strings.Join(r.NoURL, ", "))
+	}
+	if section("Keys without OTP", len(r.NoOTP)) {
+		fmt.Printf("  %s\n", strings.Join(r.NoOTP, ", "))
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+)
+
+func TestAuditKeys(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-400 * 24 * time.Hour)
+	ks := []key{
+		{Name: "bank", Password: "password", Created: old},
+		{Name: "github", Password: "t7$Kq!vZ2@pL9#wR", URL: "https://github.com", OTP: &vault.OTP{}, Created: now},
+		{Name: "gitlab", Password: "t7$Kq!vZ2@pL9#wR", URL: "https://gitlab.com", Created: now},
+		{Name: "mail", Password: "Gx8!rT2#qLm9@zW4", URL: "https://mail.example.com", OTP: &vault.OTP{}, Created: old,
+			History: []vault.PasswordChange{{Password: "old", Changed: now.Add(-24 * time.Hour)}}},
+	}
+
+	r, err := auditKeys(ks, auditOptions{MinScore: 3, MaxAge: 365 * 24 * time.Hour}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := [][]string{{"github", "gitlab"}}; !reflect.DeepEqual(r.Reused, want) {
+		t.Errorf("reused %v, want %v", r.Reused, want)
+	}
+	if len(r.Weak) != 1 || r.Weak[0].Name != "bank" {
+		t.Errorf("weak %v", r.Weak)
+	}
+	// mail changed its password yesterday
+	if len(r.Old) != 1 || r.Old[0].Name != "bank" {
+		t.Errorf("old %v", r.Old)
+	}
+	if want := []string{"bank"}; !reflect.DeepEqual(r.NoURL, want) {
+		t.Errorf("no URL %v, want %v", r.NoURL, want)
+	}
+	if want := []string{"bank", "gitlab"}; !reflect.DeepEqual(r.NoOTP, want) {
+		t.Errorf("no OTP %v, want %v", r.NoOTP, want)
+	}
+	if r.Breached != nil {
+		t.Errorf("breach check without -hibp: %v", r.Breached)
+	}
+}
+
+func TestBreachCounts(t *testing.T) {
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	h := passwordHash("password")
+	if h != "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8" {
+		t.Fatalf("hash %s", h)
+	}
+	hashes := map[string][]string{h: {"bank"}, passwordHash("unbreached"): {"mail"}}
+
+	dir := t.TempDir()
+	ranges := filepath.Join(dir, "ranges")
+	os.Mkdir(ranges, 0700)
+	for _, prefix := range []string{"5BAA6", passwordHash("unbreached")[:5]} {
+		content := "0018A45C4D1DEF81644B54AB7F969B88D65:1\n"
+		if prefix == "5BAA6" {
+			content += "1e4c9b93f3f0682250b6cf8331b7ee68fd8:9659365\r\n"
+		}
+		ioutil.WriteFile(filepath.Join(ranges, prefix+".txt"), []byte(content), 0600)
+	}
+
+	full := filepath.Join(dir, "pwned.txt")
+	ioutil.WriteFile(full, []byte("000000005AD76BD555C1D6D771DE417A4B87E4B4:10\n"+h+":9659365\n"), 0600)
+
+	for _, path := range []string{ranges, full} {
+		counts, missing, err := breachCounts(path, hashes)
+		if err != nil || len(missing) > 0 {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if want := map[string]int{h: 9659365}; !reflect.DeepEqual(counts, want) {
+			t.Errorf("%s: got %v, want %v", path, counts, want)
+		}
+	}
+
+	os.Remove(filepath.Join(ranges, "5BAA6.txt"))
+	counts, missing, err := breachCounts(ranges, hashes)
+	if err != nil || len(counts) != 0 || !reflect.DeepEqual(missing, []string{h}) {
+		t.Errorf("missing range file: %v, %v, %v", counts, missing, err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var errNoPaste = errors.New("clipboard cannot be read back")
+
+// clipboard is a way to put text on the system clipboard. Backends that
+// cannot read the clipboard back return errNoPaste from paste.
+type clipboard interface {
+	copy(text string) error
+	paste() (string, error)
+}
+
+// commandClipboard drives an external copy/paste program pair.
+type commandClipboard struct {
+	copyCmd  []string
+	pasteCmd []string
+}
+
+func (c commandClipboard) copy(text string) error {
+	cmd := exec.Command(c.copyCmd[0], c.copyCmd[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	return cmd.Run()
+}
+
+func (c commandClipboard) paste() (string, error) {
+	out, err := exec.Command(c.pasteCmd[0], c.pasteCmd[1:]...).Output()
+	return string(out), err
+}
+
+// osc52Clipboard asks the terminal emulator to set the clipboard. It works
+// over ssh but the clipboard cannot be read back.
+type osc52Clipboard struct{}
+
+func osc52Sequence(text string) string {
+	return "\x1b]52;c;" + base64.StdEncoding.EncodeToString([]byte(text)) + "\a"
+}
+
+func (osc52Clipboard) copy(text string) error {
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+
+	_, err = tty.WriteString(osc52Sequence(text))
+	return err
+}
+
+func (osc52Clipboard) paste() (string, error) {
+	return "", errNoPaste
+}
+
+var clipboards = map[string]clipboard{
+	"wl-copy": commandClipboard{[]string{"wl-copy"}, []string{"wl-paste", "--no-newline"}},
+	"xclip":   commandClipboard{[]string{"xclip", "-selection", "clipboard"}, []string{"xclip", "-selection", "clipboard", "-o"}},
+	"xsel":    commandClipboard{[]string{"xsel", "--clipboard", "--input"}, []string{"xsel", "--clipboard", "--output"}},
+	"pbcopy":  commandClipboard{[]string{"pbcopy"}, []string{"pbpaste"}},
+	"osc52":   osc52Clipboard{},
+}
+
+// clipboardName picks the backend from KEYBOX_CLIPBOARD or from what is
+// available on the system, falling back to OSC 52.
+func clipboardName() string {
+	if name := os.Getenv("KEYBOX_CLIPBOARD"); len(name) > 0 {
+		return name
+	}
+
+	var candidates []string
+	switch {
+	case runtime.GOOS == "darwin":
+		candidates = []string{"pbcopy"}
+	case len(os.Getenv("WAYLAND_DISPLAY")) > 0:
+		candidates = []string{"wl-copy", "xclip", "xsel"}
+	case len(os.Getenv("DISPLAY")) > 0:
+		candidates = []string{"xclip", "xsel"}
+	}
+
+	for _, name := range candidates {
+		if _, err := exec.LookPath(name); err == nil {
+			return name
+		}
+	}
+	return "osc52"
+}
+
+func getClipboard(name string) clipboard {
+	cb, found := clipboards[name]
+	if !found {
+		exitOnError(fmt.Sprintf("Unsupported clipboard %s", name))
+	}
+	return cb
+}
+
+func copyKey(args []string) {
+	fs := flag.NewFlagSet("copy", flag.ExitOnError)
+	field := fs.String("field", "password", "field to copy: login, password, url or a custom field")
+	clearAfter := fs.Duration("clear", 30*time.Second, "clear the clipboard after this time, 0 to keep it")
+	names := parseInterspersed(fs, args)
+	if len(names) != 1 {
+		exitOnError("Usage: keybox copy <name or query> [-field name] [-clear 30s]")
+	}
+
+	loadDBFile()
+
+	k, found := db.Get(pickKey(names[0], false))
+	if !found {
+		exitOnError(fmt.Sprintf("Key %s not found", names[0]))
+	}
+
+	text, found := keyField(k, *field)
+	if !found {
+		exitOnError(fmt.Sprintf("Unknown field %s", *field))
+	}
+
+	name := clipboardName()
+	if err := getClipboard(name).copy(text); err != nil {
+		exitOnError(fmt.Sprintf("Cannot copy to the clipboard with %s: %s", name, err))
+	}
+
+	if *clearAfter <= 0 {
+		fmt.Fprintf(os.Stderr, "Copied %s of %s to the clipboard\n", *field, k.Name)
+		return
+	}
+
+	if err := startClipboardClearer(name, text, *clearAfter); err != nil {
+		exitOnError(fmt.Sprintf("Cannot start clearing the clipboard: %s", err))
+	}
+	fmt.Fprintf(os.Stderr, "Copied %s of %s to the clipboard, clearing it in %s\n", *field, k.Name, *clearAfter)
+}
+
+// startClipboardClearer runs "keybox clearclipboard" in the background. The
+// hash of the copied text goes through a pipe so that it does not show up in
+// the process list.
+func startClipboardClearer(name, text string, after time.Duration) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256([]byte(text))
+	cmd := exec.Command(self, "clearclipboard", "-backend", name, "-after", after.String())
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// write before returning, the copy command exits right away
+	_, err = fmt.Fprintln(w, hex.EncodeToString(sum[:]))
+	w.Close()
+	return err
+}
+
+// clearClipboard is the background half of copy. It clears the clipboard
+// unless the user has copied something else in the meantime.
+func clearClipboard(args []string) {
+	fs := flag.NewFlagSet("clearclipboard", flag.ExitOnError)
+	name := fs.String("backend", clipboardName(), "clipboard backend")
+	after := fs.Duration("after", 30*time.Second, "time to wait")
+	fs.Parse(args)
+
+	// outlive the terminal the copy command was started from
+	signal.Ignore(syscall.SIGHUP, os.Interrupt)
+
+	hash, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	hash = strings.TrimSpace(hash)
+
+	time.Sleep(*after)
+
+	cb := getClipboard(*name)
+	if current, err := cb.paste(); err == nil {
+		sum := sha256.Sum256([]byte(current))
+		if hex.EncodeToString(sum[:]) != hash {
+			return
+		}
+	} else if err != errNoPaste {
+		return
+	}
+
+	cb.copy("")
+}
@@ -0,0 +1,9 @@
+package main
+
+import "testing"
+
+func TestOSC52Sequence(t *testing.T) {
+	if s := osc52Sequence("hello"); s != "\x1b]52;c;aGVsbG8=\a" {
+		t.Errorf("%q", s)
+	}
+}
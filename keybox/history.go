@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// showHistory lists the previous passwords of a key, or restores one of them
+// with -restore.
+func showHistory(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	reveal := fs.Bool("reveal", false, "show the passwords instead of masking them")
+	restore := fs.Int("restore", 0, "make the password with this number the current one")
+	names := parseInterspersed(fs, args)
+	if len(names) != 1 {
+		exitOnError("Usage: keybox history <name> [-reveal] [-restore N]")
+	}
+
+	if *restore > 0 {
+		lockDBFile()
+	}
+	loadDBFile()
+
+	k, found := db.Get(names[0])
+	if !found {
+		exitOnError(fmt.Sprintf("Key %s not found", names[0]))
+	}
+
+	if *restore > 0 {
+		if *restore > len(k.History) {
+			exitOnError(fmt.Sprintf("Key %s has no password %d", k.Name, *restore))
+		}
+		k.Password = k.History[*restore-1].Password
+		db.Put(k)
+		db.LogOp("restore-password", k.Name)
+
+		saveDBFile()
+		fmt.Printf("Restored password %d of %s\n", *restore, k.Name)
+		return
+	}
+
+	if len(k.History) == 0 {
+		fmt.Printf("Key %s has no previous passwords\n", k.Name)
+		return
+	}
+
+	cyan := color.New(color.FgCyan)
+	blue := color.New(color.FgBlue)
+	for i, c := range k.History {
+		p := passwordMask
+		if *reveal {
+			p = c.Password
+		}
+		cyan.Printf("%3d  %-25s", i+1, c.Changed.Format(time.RFC3339))
+		blue.Println(p)
+	}
+}
+
+func showLog(args []string) {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	n := fs.Int("n", 0, "show the last n records only")
+	asJSON := fs.Bool("json", false, "print the log as JSON")
+	fs.Parse(args)
+
+	loadDBFile()
+
+	records := db.Log()
+	if *n > 0 && *n < len(records) {
+		records = records[len(records)-*n:]
+	}
+
+	if *asJSON {
+		printJSON(records)
+		return
+	}
+
+	for _, r := range records {
+		fmt.Printf("%-25s %-18s %s\n", r.Time.Format(time.RFC3339), r.Op, r.Name)
+	}
+}
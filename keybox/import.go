@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+)
+
+// importers read the keys of another password manager from path.
+var importers = map[string]func(path string, mapping string) ([]key, error){
+	"keepass":   importKeePass,
+	"bitwarden": importBitwarden,
+	"1password": import1Password,
+	"pass":      importPass,
+	"csv":       importCSV,
+}
+
+var mergePolicies = []string{"skip", "overwrite", "rename"}
+
+// csvFields are the key fields a csv column can be mapped to.
+var csvFields = []string{"name", "login", "password", "url", "notes", "tags", "otp"}
+
+func importKeys(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	format := fs.String("format", "", "format of the file: "+strings.Join(importerNames(), ", "))
+	mapping := fs.String("map", "", "csv column mapping, e.g. name=Title,login=User,password=Pass,url=URL,notes=Notes,tags=Tags,otp=TOTP")
+	policy := fs.String("on-conflict", "skip", "what to do with names that exist already: "+strings.Join(mergePolicies, ", "))
+	dryRun := fs.Bool("n", false, "only show what would be imported")
+	paths := parseInterspersed(fs, args)
+	if len(paths) != 1 {
+		exitOnError("Usage: keybox import -format name [-map columns] [-on-conflict skip|overwrite|rename] [-n] <file or directory>")
+	}
+
+	importer, found := importers[*format]
+	if !found {
+		exitOnError(fmt.Sprintf("Unknown format %q, expected one of %s", *format, strings.Join(importerNames(), ", ")))
+	}
+	if !validPolicy(*policy) {
+		exitOnError(fmt.Sprintf("Unknown conflict policy %s, expected one of %s", *policy, strings.Join(mergePolicies, ", ")))
+	}
+
+	imported, err := importer(paths[0], *mapping)
+	if err != nil {
+		exitOnError(fmt.Sprintf("Cannot import %s: %s", paths[0], err))
+	}
+
+	lockDBFile()
+	loadDBFile()
+
+	db.LogOp("import", *format)
+	added, updated, skipped := mergeKeys(imported, *policy)
+	for _, name := range skipped {
+		fmt.Printf("Skipped %s, it exists already\n", name)
+	}
+	fmt.Printf("%d added, %d overwritten, %d skipped\n", added, updated, len(skipped))
+
+	if *dryRun {
+		return
+	}
+
+	saveDBFile()
+}
+
+// mergeKeys adds the keys resolving duplicate names with policy. Keys that
+// are new keep the timestamps of the source when it has them.
+func mergeKeys(imported []key, policy string) (added, updated int, skipped []string) {
+	for _, k := range imported {
+		if len(k.Name) == 0 {
+			continue
+		}
+
+		if _, found := db.Get(k.Name); found {
+			switch policy {
+			case "skip":
+				skipped = append(skipped, k.Name)
+				continue
+			case "rename":
+				k.Name = uniqueName(k.Name)
+			case "overwrite":
+				// no format carries these, they are kept
+				old, _ := db.Get(k.Name)
+				k.SSH, k.Attachments = old.SSH, old.Attachments
+				db.Put(k)
+				updated++
+				continue
+			}
+		}
+
+		created, modified := k.Created, k.Modified
+		db.Put(k)
+		k, _ = db.Get(k.Name)
+		if !created.IsZero() {
+			k.Created = created
+		}
+		if !modified.IsZero() {
+			k.Modified = modified
+		}
+		db.Store(k)
+		added++
+	}
+	return
+}
+
+// uniqueName returns "name (2)", "name (3)", ... whichever is free.
+func uniqueName(name string) string {
+	for i := 2; ; i++ {
+		n := fmt.Sprintf("%s (%d)", name, i)
+		if _, found := db.Get(n); !found {
+			return n
+		}
+	}
+}
+
+func validPolicy(policy string) bool {
+	for _, p := range mergePolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+func importerNames() []string {
+	names := make([]string, 0, len(importers))
+	for name := range importers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type keepassFile struct {
+	Groups []keepassGroup `xml:"Root>Group"`
+}
+
+type keepassGroup struct {
+	Name    string
+	Groups  []keepassGroup `xml:"Group"`
+	Entries []keepassEntry `xml:"Entry"`
+}
+
+type keepassEntry struct {
+	Strings []struct {
+		Key   string
+		Value struct {
+			Value     string `xml:",chardata"`
+			Protected string `xml:"ProtectInMemory,attr"`
+		}
+	} `xml:"String"`
+	Tags  string
+	Times struct {
+		CreationTime         string
+		LastModificationTime string
+	}
+}
+
+// importKeePass reads a KeePass 2 XML export. The group path below the root
+// group becomes a tag.
+func importKeePass(path, _ string) ([]key, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var kf keepassFile
+	if err := xml.NewDecoder(f).Decode(&kf); err != nil {
+		return nil, err
+	}
+
+	var ks []key
+	var walk func(g keepassGroup, groupPath string)
+	walk = func(g keepassGroup, groupPath string) {
+		for _, e := range g.Entries {
+			k := key{Tags: parseTags(strings.ReplaceAll(e.Tags, ";", ","))}
+			otp := ""
+			if len(groupPath) > 0 {
+				k.Tags = append(k.Tags, groupPath)
+			}
+			for _, s := range e.Strings {
+				v := s.Value.Value
+				switch s.Key {
+				case "Title":
+					k.Name = v
+				case "UserName":
+					k.Login = v
+				case "Password":
+					k.Password = v
+				case "URL":
+					k.URL = v
+				case "Notes":
+					k.Notes = v
+				case "otp":
+					otp = v
+				default:
+					if len(v) > 0 {
+						t := "text"
+						if s.Value.Protected == "True" {
+							t = "hidden"
+						}
+						k.SetField(field{Name: s.Key, Type: t, Value: v})
+					}
+				}
+			}
+			if len(otp) > 0 {
+				k.OTP = otpFromString(k.Name, otp)
+			}
+			k.Created, _ = time.Parse(time.RFC3339, e.Times.CreationTime)
+			k.Modified, _ = time.Parse(time.RFC3339, e.Times.LastModificationTime)
+			ks = append(ks, k)
+		}
+		for _, sub := range g.Groups {
+			p := sub.Name
+			if len(groupPath) > 0 {
+				p = groupPath + "/" + sub.Name
+			}
+			walk(sub, p)
+		}
+	}
+	for _, root := range kf.Groups {
+		walk(root, "")
+	}
+	return ks, nil
+}
+
+type bitwardenExport struct {
+	Folders []struct {
+		ID   string
+		Name string
+	}
+	Items []struct {
+		Type         int
+		Name         string
+		Notes        string
+		FolderID     string
+		CreationDate time.Time
+		RevisionDate time.Time
+		Login        struct {
+			Username string
+			Password string
+			TOTP     string
+			URIs     []struct {
+				URI string
+			}
+		}
+		Fields []struct {
+			Name  string
+			Value string
+			Type  int // 0 text, 1 hidden
+		}
+	}
+}
+
+// importBitwarden reads an unencrypted Bitwarden JSON export. Logins and
+// secure notes are imported, the folder becomes a tag.
+func importBitwarden(path, _ string) ([]key, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var export bitwardenExport
+	if err := json.Unmarshal(content, &export); err != nil {
+		return nil, err
+	}
+
+	folders := make(map[string]string)
+	for _, f := range export.Folders {
+		folders[f.ID] = f.Name
+	}
+
+	var ks []key
+	for _, item := range export.Items {
+		// 1 login, 2 secure note
+		if item.Type != 1 && item.Type != 2 {
+			continue
+		}
+
+		k := key{
+			Name:     item.Name,
+			Login:    item.Login.Username,
+			Password: item.Login.Password,
+			Notes:    item.Notes,
+			Created:  item.CreationDate,
+			Modified: item.RevisionDate,
+		}
+		if folder, found := folders[item.FolderID]; found {
+			k.Tags = []string{folder}
+		}
+		for i, u := range item.Login.URIs {
+			if i == 0 {
+				k.URL = u.URI
+			} else {
+				k.SetField(field{Name: fmt.Sprintf("url%d", i+1), Type: "url", Value: u.URI})
+			}
+		}
+		if len(item.Login.TOTP) > 0 {
+			k.OTP = otpFromString(k.Name, item.Login.TOTP)
+		}
+		for _, f := range item.Fields {
+			t := "text"
+			if f.Type == 1 {
+				t = "hidden"
+			}
+			k.SetField(field{Name: f.Name, Type: t, Value: f.Value})
+		}
+		ks = append(ks, k)
+	}
+	return ks, nil
+}
+
+// otpFromString accepts an otpauth:// URI or a bare base32 TOTP secret of
+// the key name. An invalid secret is reported on stderr and nil returned, so
+// that the key is imported without it.
+func otpFromString(name, s string) *vault.OTP {
+	var o *vault.OTP
+	var err error
+	if strings.HasPrefix(s, "otpauth://") {
+		o, err = vault.ParseOTPURI(s)
+	} else {
+		o = &vault.OTP{Type: "totp", Secret: s, Algorithm: "SHA1", Digits: 6, Period: 30}
+		err = o.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Skipped the OTP secret of %s: %s\n", name, err)
+		return nil
+	}
+	return o
+}
+
+// onePasswordMapping matches the CSV export of 1Password 7 and 8.
+const onePasswordMapping = "name=Title,url=Url|URL|Website,login=Username,password=Password,otp=OTPAuth|One-time password,tags=Tags,notes=Notes|notesPlain"
+
+func import1Password(path, mapping string) ([]key, error) {
+	if len(mapping) == 0 {
+		mapping = onePasswordMapping
+	}
+	return importCSV(path, mapping)
+}
+
+// importCSV reads a CSV file with a header row. mapping maps the key fields
+// name, login, password, url, notes, tags and otp to column names; a column
+// name may list alternatives separated by |. Without a mapping the columns
+// are expected to be named like the fields. Unmapped columns become custom
+// fields.
+func importCSV(path, mapping string) ([]key, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+
+	r := csv.NewReader(bytes.NewReader(content))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, h := range header {
+		columns[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+
+	m := make(map[string]string)
+	if len(mapping) == 0 {
+		for _, f := range csvFields {
+			m[f] = f
+		}
+	}
+	for _, pair := range strings.Split(mapping, ",") {
+		if len(pair) == 0 {
+			continue
+		}
+		f, col, found := strings.Cut(pair, "=")
+		if !found || !isCSVField(strings.TrimSpace(f)) {
+			return nil, fmt.Errorf("Invalid mapping %s, expected field=column with field one of %s", pair, strings.Join(csvFields, ", "))
+		}
+		m[strings.TrimSpace(f)] = col
+	}
+
+	index := make(map[string]int)
+	mapped := make(map[int]bool)
+	for f, cols := range m {
+		for _, col := range strings.Split(cols, "|") {
+			if i, found := columns[strings.ToLower(strings.TrimSpace(col))]; found {
+				index[f] = i
+				mapped[i] = true
+				break
+			}
+		}
+	}
+	if _, found := index["name"]; !found {
+		return nil, fmt.Errorf("No name column in %s", strings.Join(header, ","))
+	}
+
+	var ks []key
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		get := func(f string) string {
+			if i, found := index[f]; found && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+
+		k := key{
+			Name:     get("name"),
+			Login:    get("login"),
+			Password: get("password"),
+			URL:      get("url"),
+			Notes:    get("notes"),
+			Tags:     parseTags(get("tags")),
+		}
+		if otp := get("otp"); len(otp) > 0 {
+			k.OTP = otpFromString(k.Name, otp)
+		}
+		for i, v := range record {
+			if !mapped[i] && i < len(header) && len(v) > 0 {
+				k.SetField(field{Name: strings.TrimPrefix(header[i], csvFieldPrefix), Type: "text", Value: v})
+			}
+		}
+		ks = append(ks, k)
+	}
+	return ks, nil
+}
+
+// csvFieldPrefix marks the columns of custom fields whose names would be
+// taken for key fields.
+const csvFieldPrefix = "field:"
+
+// csvColumn returns the column of the custom field name in an export.
+func csvColumn(name string) string {
+	if isCSVField(strings.ToLower(strings.TrimSpace(name))) || strings.HasPrefix(name, csvFieldPrefix) {
+		return csvFieldPrefix + name
+	}
+	return name
+}
+
+func isCSVField(f string) bool {
+	for _, c := range csvFields {
+		if c == f {
+			return true
+		}
+	}
+	return false
+}
+
+// importPass reads a pass(1) store. Every .gpg file is decrypted with gpg,
+// its name relative to the store is the key name.
+func importPass(dir, _ string) ([]key, error) {
+	var ks []key
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && strings.HasPrefix(info.Name(), ".") && path != dir {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || filepath.Ext(path) != ".gpg" {
+			return nil
+		}
+
+		out, err := exec.Command("gpg", "--quiet", "--batch", "--decrypt", path).Output()
+		if err != nil {
+			return fmt.Errorf("gpg --decrypt %s: %s", path, err)
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		k := parsePassEntry(filepath.ToSlash(strings.TrimSuffix(rel, ".gpg")), string(out))
+		k.Modified = info.ModTime()
+		ks = append(ks, k)
+		return nil
+	})
+	return ks, err
+}
+
+// parsePassEntry follows the pass conventions: the password on the first
+// line, then "key: value" lines and free text.
+func parsePassEntry(name, content string) key {
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	k := key{Name: name, Password: lines[0]}
+	if dir := filepath.Dir(filepath.FromSlash(name)); dir != "." {
+		k.Tags = []string{filepath.ToSlash(dir)}
+	}
+
+	var notes []string
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(line, "otpauth://") {
+			k.OTP = otpFromString(name, line)
+			continue
+		}
+
+		f, v, found := strings.Cut(line, ":")
+		v = strings.TrimSpace(v)
+		switch strings.ToLower(f) {
+		case "login", "username", "user", "email":
+			if found && len(k.Login) == 0 {
+				k.Login = v
+				continue
+			}
+		case "url", "website":
+			if found && len(k.URL) == 0 {
+				k.URL = v
+				continue
+			}
+		}
+		notes = append(notes, line)
+	}
+	k.Notes = strings.TrimSpace(strings.Join(notes, "\n"))
+	return k
+}
+
+// exportKeys writes every key unencrypted to a CSV or JSON file, after an
+// explicit confirmation.
+func exportKeys(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "json", "format of the file: csv or json")
+	yes := fs.Bool("yes-unencrypted", false, "do not ask for confirmation")
+	paths := parseInterspersed(fs, args)
+	if len(paths) != 1 || (*format != "csv" && *format != "json") {
+		exitOnError("Usage: keybox export [-format csv|json] [-yes-unencrypted] <file>")
+	}
+
+	loadDBFile()
+
+	if !*yes {
+		fmt.Fprintf(os.Stderr, "This writes all %d passwords UNENCRYPTED to %s.\n", db.Len(), paths[0])
+		if getPromptedInput("Type EXPORT to continue") != "EXPORT" {
+			exitOnError("Export cancelled")
+		}
+	}
+
+	var buf bytes.Buffer
+	list := db.List()
+
+	if *format == "json" {
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(list); err != nil {
+			exitOnError(err.Error())
+		}
+	} else {
+		writeCSV(&buf, list)
+	}
+
+	f, err := os.OpenFile(paths[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		exitOnError(fmt.Sprintf("Cannot create %s: %s", paths[0], err))
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		exitOnError(err.Error())
+	}
+	if err := f.Close(); err != nil {
+		exitOnError(err.Error())
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d keys to %s\n", len(list), paths[0])
+}
+
+// writeCSV writes ks with the columns of csvFields. Custom fields go in
+// extra columns, which import reads back.
+func writeCSV(w io.Writer, ks []key) {
+	var extra []string
+	seen := make(map[string]bool)
+	for _, k := range ks {
+		for _, f := range k.Fields {
+			if !seen[f.Name] {
+				seen[f.Name] = true
+				extra = append(extra, f.Name)
+			}
+		}
+	}
+	sort.Strings(extra)
+
+	cw := csv.NewWriter(w)
+	header := append([]string(nil), csvFields...)
+	for _, name := range extra {
+		header = append(header, csvColumn(name))
+	}
+	cw.Write(header)
+	for _, k := range ks {
+		otp := ""
+		if k.OTP != nil {
+			otp = k.OTP.URI()
+		}
+		record := []string{k.Name, k.Login, k.Password, k.URL, k.Notes, strings.Join(k.Tags, ","), otp}
+		values := make(map[string]string)
+		for _, f := range k.Fields {
+			values[f.Name] = f.Value
+		}
+		for _, name := range extra {
+			record = append(record, values[name])
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+}
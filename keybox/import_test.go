@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+)
+
+func writeTemp(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestImportKeePass(t *testing.T) {
+	path := writeTemp(t, "db.xml", `<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<KeePassFile><Root><Group><Name>Database</Name>
+	<Entry>
+		<String><Key>Title</Key><Value>mail</Value></String>
+		<String><Key>UserName</Key><Value>me@example.com</Value></String>
+		<String><Key>Password</Key><Value ProtectInMemory="True">pw1</Value></String>
+		<String><Key>PIN</Key><Value ProtectInMemory="True">1234</Value></String>
+		<Times><CreationTime>2019-05-01T10:00:00Z</CreationTime></Times>
+	</Entry>
+	<Group><Name>Work</Name>
+		<Entry>
+			<String><Key>Title</Key><Value>vpn</Value></String>
+			<String><Key>URL</Key><Value>https://vpn.example.com</Value></String>
+			<Tags>infra;remote</Tags>
+		</Entry>
+	</Group>
+</Group></Root></KeePassFile>`)
+
+	ks, err := importKeePass(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ks) != 2 {
+		t.Fatalf("got %d keys", len(ks))
+	}
+	if k := ks[0]; k.Name != "mail" || k.Login != "me@example.com" || k.Password != "pw1" ||
+		len(k.Fields) != 1 || k.Fields[0] != (field{Name: "PIN", Type: "hidden", Value: "1234"}) || k.Created.Year() != 2019 {
+		t.Errorf("unexpected %+v", k)
+	}
+	if k := ks[1]; k.URL != "https://vpn.example.com" || len(k.Tags) != 3 || k.Tags[2] != "Work" {
+		t.Errorf("unexpected %+v", k)
+	}
+}
+
+func TestImportBitwarden(t *testing.T) {
+	path := writeTemp(t, "bw.json", `{
+  "folders": [{"id": "f1", "name": "Social"}],
+  "items": [
+    {"type": 1, "name": "forum", "folderId": "f1", "notes": "old account",
+     "login": {"username": "me", "password": "pw", "totp": "JBSWY3DPEHPK3PXP",
+               "uris": [{"uri": "https://forum.example.com"}, {"uri": "https://m.forum.example.com"}]},
+     "fields": [{"name": "answer", "value": "blue", "type": 1}]},
+    {"type": 3, "name": "a card"}
+  ]
+}`)
+
+	ks, err := importBitwarden(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ks) != 1 {
+		t.Fatalf("got %d keys", len(ks))
+	}
+	k := ks[0]
+	if k.Name != "forum" || k.Login != "me" || k.URL != "https://forum.example.com" || k.Tags[0] != "Social" ||
+		k.OTP == nil || len(k.Fields) != 2 || k.Fields[1] != (field{Name: "answer", Type: "hidden", Value: "blue"}) {
+		t.Errorf("unexpected %+v", k)
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	path := writeTemp(t, "1p.csv", "\xef\xbb\xbfTitle,Url,Username,Password,OTPAuth,Favorite,Archived,Tags,Notes\n"+
+		"bank,https://bank.example.com,me,pw,,false,false,\"money,home\",\n")
+	ks, err := import1Password(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ks) != 1 || ks[0].Name != "bank" || ks[0].Password != "pw" || len(ks[0].Tags) != 2 || len(ks[0].Fields) != 2 {
+		t.Errorf("unexpected %+v", ks)
+	}
+
+	path = writeTemp(t, "generic.csv", "Site;User;Secret\nshop;me;pw\n")
+	if _, err := importCSV(path, "name=Site,login=User,password=Secret"); err == nil {
+		t.Error("expected an error for a file without the mapped columns")
+	}
+	path = writeTemp(t, "generic.csv", "Site,User,Secret\nshop,me,pw\n")
+	ks, err = importCSV(path, "name=Site,login=User,password=Secret")
+	if err != nil || len(ks) != 1 || !reflect.DeepEqual(ks[0], key{Name: "shop", Login: "me", Password: "pw"}) {
+		t.Errorf("unexpected %+v, %v", ks, err)
+	}
+	if _, err := importCSV(path, "nickname=Site"); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+
+	// custom fields named like key fields make it back
+	fields := []field{{Name: "Password", Type: "text", Value: "old"}, {Name: "field:x", Type: "text", Value: "x"}, {Name: "pin", Type: "text", Value: "1234"}}
+	var buf bytes.Buffer
+	writeCSV(&buf, []key{{Name: "shop", Password: "pw", Fields: fields}})
+	ks, err = importCSV(writeTemp(t, "export.csv", buf.String()), "")
+	if err != nil || len(ks) != 1 || ks[0].Password != "pw" || !reflect.DeepEqual(ks[0].Fields, fields) {
+		t.Errorf("round trip: %+v, %v", ks, err)
+	}
+}
+
+func TestParsePassEntry(t *testing.T) {
+	if k := parsePassEntry("shop", "pw\notpauth://totp/shop?secret=not-base32\n"); k.OTP != nil {
+		t.Errorf("invalid OTP imported: %+v", k.OTP)
+	}
+	k := parsePassEntry("web/shop", "pw\r\nlogin: me\r\nurl: https://shop.example.com\r\notpauth://totp/shop?secret=JBSWY3DPEHPK3PXP\r\nsecurity question: pet\r\n")
+	if k.Name != "web/shop" || k.Password != "pw" || k.Login != "me" || k.URL != "https://shop.example.com" ||
+		k.OTP == nil || k.Notes != "security question: pet" || k.Tags[0] != "web" {
+		t.Errorf("unexpected %+v", k)
+	}
+}
+
+func TestMergeKeys(t *testing.T) {
+	for policy, want := range map[string][]string{
+		"skip":      {"pw", ""},
+		"overwrite": {"new", ""},
+		"rename":    {"pw", "new"},
+	} {
+		useKeys(t, key{Name: "a", Password: "pw", SSH: &vault.SSHKey{Comment: "a"}})
+		mergeKeys([]key{{Name: "a", Password: "new"}}, policy)
+		a, _ := db.Get("a")
+		renamed, _ := db.Get("a (2)")
+		if a.Password != want[0] || renamed.Password != want[1] || a.SSH == nil {
+			t.Errorf("%s: unexpected %+v", policy, db.List())
+		}
+	}
+}
@@ -2,337 +2,702 @@ package main
 
 import (
 	"bufio"
-	"crypto/aes"
-	"crypto/cipher"
-	crand "crypto/rand"
-	"crypto/sha256"
-	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	mrand "math/rand"
 	"os"
-	"sort"
-	"time"
+	"os/signal"
+	"strings"
 
+	"filippo.io/age"
 	"github.com/fatih/color"
+	"github.com/goofy-coder/Go/keybox/vault"
+	"golang.org/x/term"
 )
 
-type key struct {
-	Name     string
-	Login    string
-	Password string
-}
+type key = vault.Key
+type field = vault.Field
 
 var dbpath string
-var cryptokey []byte
-var iv []byte = make([]byte, aes.BlockSize)
-var keys = make(map[string]key)
 
-func init() {
-	// set up dbpath
-	dbpath = os.Getenv("KEYBOXFILE")
-	if len(dbpath) == 0 {
-		exitOnError("KEYBOXFILE environment variable is not set")
-	}
-}
+// db is the vault at dbpath, set by loadDBFile
+var db *vault.Vault
+
+const (
+	passwordMask       = "********"
+	maxPassphraseTries = 3
+)
+
+var passphraseFD = flag.Int("passphrase-fd", -1, "read the passphrase from this file descriptor")
+var wait = flag.Bool("wait", false, "wait for the vault lock instead of failing")
+var cachedPassphrase *string
+var passphrasePrompted bool
+var stdin = bufio.NewReader(os.Stdin)
 
 func main() {
-	usage := "keybox {create | info | list | update | delete | restore | createpassword}"
-	if len(os.Args) <= 1 {
+	usage := "keybox [-vault name] [-passphrase-fd N] [-wait] {create | info | vault | use | transfer | sync | list | search | tui | audit | get | set | rm | update | delete | restore | passwd | rekdf | member | agent | lock | serve | clients | ssh | ssh-agent | attach | detach | copy | history | log | otp | import | export | createpassword}"
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
 		fmt.Println(usage)
 		return
 	}
 
-	switch os.Args[1] {
+	defer closeStores()
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "info", "vault", "use", "agent", "lock", "clients", "createpassword", "clearclipboard":
+	default:
+		selectVault()
+	}
+
+	switch flag.Arg(0) {
 	case "create":
-		createDBFile()
+		createDBFile(args)
 	case "info":
 		info()
+	case "vault":
+		manageVaults(args)
+	case "use":
+		useVault(args)
+	case "transfer":
+		transferKeys(args)
+	case "sync":
+		syncVault(args)
 	case "delete":
 		deleteKeys()
 	case "update":
 		upsertKeys()
 	case "list":
-		showKeys()
+		showKeys(args)
+	case "search":
+		searchCmd(args)
+	case "tui":
+		runTUI(args)
+	case "audit":
+		auditCmd(args)
+	case "get":
+		getKey(args)
+	case "set":
+		setKey(args)
+	case "rm":
+		removeKeys(args)
 	case "createpassword":
-		fmt.Println(newPassword())
+		createPassword(args)
 	case "restore":
-		restoreDBFile()
+		restoreDBFile(args)
+	case "rekdf":
+		rekdf(args)
+	case "passwd":
+		changePassphrase(args)
+	case "member":
+		manageMembers(args)
+	case "agent":
+		runAgent(args)
+	case "lock":
+		lockAgent()
+	case "serve":
+		serveAPI(args)
+	case "ssh":
+		sshKeyCmd(args)
+	case "ssh-agent":
+		runSSHAgent(args)
+	case "attach":
+		attachFile(args)
+	case "detach":
+		detachFile(args)
+	case "clients":
+		manageClients(args)
+	case "copy":
+		copyKey(args)
+	case "history":
+		showHistory(args)
+	case "log":
+		showLog(args)
+	case "otp":
+		showOTP(args)
+	case "import":
+		importKeys(args)
+	case "export":
+		exportKeys(args)
+	case "clearclipboard":
+		clearClipboard(args)
 	default:
-		fmt.Printf("Unsupported command %s\n", os.Args[1])
+		fmt.Printf("Unsupported command %s\n", flag.Arg(0))
 		fmt.Println(usage)
 		return
 	}
 }
 
-func createDBFile() {
-	passphrase := getPromptedInput("Password")
-	if passphrase != getPromptedInput("Confirm Password") {
-		exitOnError("Password do not match")
-	} else {
-		setCryptoKey(passphrase)
+func createDBFile(args []string) {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	newKDF := kdfFlags(fs)
+	fs.Parse(args)
+
+	p, err := newKDF()
+	if err != nil {
+		exitOnError(err.Error())
 	}
 
-	if stat, _ := os.Stat(dbpath); stat != nil {
-		exitOnError(fmt.Sprintf("File \"%s\" already exists", dbpath))
+	passphrase := readPassphrase()
+	if passphrasePrompted && passphrase != getSecretInput("Confirm Password") {
+		exitOnError("Password do not match")
 	}
 
-	if _, err := io.ReadFull(crand.Reader, iv); err != nil {
+	lockDBFile()
+	if db, err = vault.Create(mustOpenStore(), p, passphrase); err != nil {
 		exitOnError(err.Error())
 	}
-
-	keys["example"] = key{"example", "login", "password"}
+	db.Put(key{Name: "example", Login: "login", Password: "password", URL: "https://example.com"})
 
 	saveDBFile()
 }
 
 func info() {
-	fmt.Println("Checking KEYBOXFILE environment variable...")
-	finfo, err := os.Stat(dbpath)
-	if os.IsNotExist(err) {
+	c, err := loadConfig()
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	if len(c.Vaults) > 0 {
+		fmt.Println("Vaults:")
+		listVaults(c)
+	}
+
+	if dbpath, err = c.resolve(*vaultName); err != nil {
+		exitOnError(err.Error())
+	}
+	v, err := vault.OpenStore(mustOpenStore())
+	if err == vault.ErrNotFound {
 		exitOnError(fmt.Sprintf("Keybox file %s does not exit. Use create command to create one\n", dbpath))
-	} else {
-		fmt.Printf("Keybox file %s\n", dbpath)
+	}
+	fmt.Printf("Keybox file %s\n", dbpath)
+	if finfo, err := os.Stat(localPath(dbpath)); err == nil {
 		fmt.Printf("Last modified at %s\n", finfo.ModTime())
 	}
+
+	if err == nil {
+		fmt.Printf("Format v%d, key derivation %s\n", v.Version(), v.KDF())
+	}
 }
 
-func restoreDBFile() {
-	if err := os.Rename(dbpath+".sav", dbpath); err != nil {
-		exitOnError(fmt.Sprintf("Retore failed: %s\n", err))
+// rekdf re-encrypts the file with new key derivation parameters and a fresh
+// salt. The passphrase stays the same.
+func rekdf(args []string) {
+	fs := flag.NewFlagSet("rekdf", flag.ExitOnError)
+	newKDF := kdfFlags(fs)
+	fs.Parse(args)
+
+	p, err := newKDF()
+	if err != nil {
+		exitOnError(err.Error())
+	}
+
+	lockDBFile()
+	loadDBFile()
+	passphrase := verifyPassphrase()
+
+	fmt.Printf("Key derivation %s -> %s\n", db.KDF(), p)
+	db.LogOp("rekdf", p.String())
+	if err := db.SetPassphrase(passphrase, p); err != nil {
+		exitOnError(err.Error())
 	}
+
+	saveDBFile()
 }
 
-func upsertKeys() {
-	passphrase := getPromptedInput("Password")
-	setCryptoKey(passphrase)
+// changePassphrase checks the current passphrase and wraps the data key with
+// a key derived from the new one and a fresh salt. With -rotate the data key
+// is replaced as well.
+func changePassphrase(args []string) {
+	fs := flag.NewFlagSet("passwd", flag.ExitOnError)
+	rotate := fs.Bool("rotate", false, "also replace the data encryption key")
+	newFD := fs.Int("new-passphrase-fd", -1, "read the new passphrase from this file descriptor")
+	fs.Parse(args)
 
+	lockDBFile()
 	loadDBFile()
+	verifyPassphrase()
+
+	var passphrase string
+	if *newFD >= 0 {
+		passphrase = readPassphraseFD(*newFD)
+	} else {
+		passphrase = getSecretInput("New password")
+		if passphrase != getSecretInput("Confirm new password") {
+			exitOnError("Password do not match")
+		}
+	}
+	if len(passphrase) == 0 {
+		exitOnError("Empty password")
+	}
 
-	// Make a copy of the db file
-	if err := os.Rename(dbpath, dbpath+".sav"); err != nil {
-		exitOnError(fmt.Sprintf("Cannot save to file %s.sav: %s", dbpath, err))
+	kdf := db.KDF()
+	id := kdf.KDF
+	if id == vault.KDFSHA256 {
+		id = vault.KDFArgon2id
+	}
+	p, err := vault.NewKDFParams(id)
+	if err != nil {
+		exitOnError(err.Error())
 	}
+	if id == kdf.KDF {
+		// keep the cost, only the salt is new
+		p.Time, p.Memory, p.Threads = kdf.Time, kdf.Memory, kdf.Threads
+	}
+	if err := db.SetPassphrase(passphrase, p); err != nil {
+		exitOnError(err.Error())
+	}
+
+	db.LogOp("passwd", "")
+	if *rotate {
+		if err := db.RotateKey(); err != nil {
+			exitOnError(err.Error())
+		}
+		db.LogOp("rotate-key", "")
+	}
+
+	saveDBFile()
+	agentPutKey(db.Key())
+	fmt.Fprintln(os.Stderr, "Password changed, the backups still open with the old one")
+}
+
+// verifyPassphrase returns the passphrase of the loaded vault. When it was
+// opened with the key of the agent, which does not prove that the
+// passphrase is known, the passphrase is asked for and checked.
+func verifyPassphrase() string {
+	if db.Team() {
+		exitOnError("Team vaults have no passphrase, see keybox member")
+	}
+
+	passphrase := readPassphrase()
+	if err := db.CheckPassphrase(passphrase); err != nil {
+		exitOnError(err.Error())
+	}
+	return passphrase
+}
+
+// kdfFlags registers the key derivation flags on fs. The returned function
+// builds the parameters once fs has been parsed.
+func kdfFlags(fs *flag.FlagSet) func() (*vault.KDFParams, error) {
+	name := fs.String("kdf", "argon2id", "key derivation function: argon2id or scrypt")
+	t := fs.Uint("time", 0, "argon2id iterations or scrypt log2(N), 0 for the default")
+	memory := fs.Uint("memory", 0, "argon2id memory in KiB or scrypt r, 0 for the default")
+	threads := fs.Uint("threads", 0, "argon2id parallelism or scrypt p, 0 for the default")
+
+	return func() (*vault.KDFParams, error) {
+		id, found := vault.KDFNames[*name]
+		if !found || id == vault.KDFSHA256 {
+			return nil, fmt.Errorf("Unsupported kdf %s", *name)
+		}
+
+		p, err := vault.NewKDFParams(id)
+		if err != nil {
+			return nil, err
+		}
+		if *t > 0 {
+			p.Time = uint32(*t)
+		}
+		if *memory > 0 {
+			p.Memory = uint32(*memory)
+		}
+		if *threads > 0 {
+			p.Threads = uint8(*threads)
+		}
+		return p, p.Validate()
+	}
+}
+
+func upsertKeys() {
+	lockDBFile()
+	loadDBFile()
 
 	for {
 		k := promptForKey()
 		if k == nil {
 			break
 		}
-		if _, found := keys[k.Name]; !found {
-			keys[k.Name] = *k
-		} else {
+		if old, found := db.Get(k.Name); found {
 			fmt.Println("Key exits, overwrite...")
-			keys[k.Name] = *k
+			// keep what was not asked for or left blank
+			if len(k.URL) == 0 {
+				k.URL = old.URL
+			}
+			if len(k.Tags) == 0 {
+				k.Tags = old.Tags
+			}
+			k.Notes, k.Fields = old.Notes, old.Fields
+			k.SSH, k.Attachments = old.SSH, old.Attachments
 		}
+		db.Put(*k)
 	}
 
 	saveDBFile()
 }
 
-func showKeys() {
-	passphrase := getPromptedInput("Password")
-	setCryptoKey(passphrase)
+func showKeys(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the keys as JSON")
+	reveal := fs.Bool("reveal", false, "show the passwords instead of masking them")
+	fs.Parse(args)
+
 	loadDBFile()
 
-	ks := make([]string, 0, len(keys))
-	for k := range keys {
-		ks = append(ks, k)
+	printKeys(db.List(), *asJSON, *reveal)
+}
+
+// printKeys prints the keys as a table or as JSON, the secrets masked
+// unless reveal is set.
+func printKeys(list []key, asJSON, reveal bool) {
+	if !reveal {
+		masked := make([]key, len(list))
+		for i, k := range list {
+			masked[i] = maskKey(k)
+		}
+		list = masked
 	}
 
-	sort.Strings(ks)
+	if asJSON {
+		if list == nil {
+			list = []key{}
+		}
+		printJSON(list)
+		return
+	}
 
 	cyan := color.New(color.FgCyan)
 	red := color.New(color.FgRed)
 	blue := color.New(color.FgBlue)
-	for _, k := range ks {
-		v := keys[k]
+	for _, v := range list {
 		cyan.Printf("%-20s", v.Name)
 		red.Printf("%-25s", v.Login)
 		blue.Println(v.Password)
 	}
 
-	red.Println("!!! DO NOT FORGET TO CLOSE THE WINDOW !!!")
+	if reveal {
+		red.Println("!!! DO NOT FORGET TO CLOSE THE WINDOW !!!")
+	}
+}
+
+// maskKey hides the password, the hidden fields, the OTP secret, the SSH
+// private key and the keys of the attachments of k.
+func maskKey(k key) key {
+	k.Password = passwordMask
+	k.Fields = append([]field(nil), k.Fields...)
+	for i := range k.Fields {
+		if k.Fields[i].Type == "hidden" {
+			k.Fields[i].Value = passwordMask
+		}
+	}
+	if k.OTP != nil {
+		otp := *k.OTP
+		otp.Secret = passwordMask
+		k.OTP = &otp
+	}
+	if k.SSH != nil {
+		s := *k.SSH
+		s.PrivateKey = passwordMask
+		k.SSH = &s
+	}
+	k.Attachments = append([]vault.Attachment(nil), k.Attachments...)
+	for i := range k.Attachments {
+		k.Attachments[i].Key = nil
+	}
+	return k
 }
 
 func deleteKeys() {
-	passphrase := getPromptedInput("Password")
-	setCryptoKey(passphrase)
-
+	lockDBFile()
 	loadDBFile()
 
-	// make a copy
-	if err := os.Rename(dbpath, dbpath+".sav"); err != nil {
-		exitOnError(fmt.Sprintf("Cannot save to file %s.sav: %s", dbpath, err))
-	}
-
 	for {
-		name := getPromptedInput("Name")
-		if len(name) == 0 {
+		query := getPromptedInput("Name")
+		if len(query) == 0 {
 			break
 		}
-		delete(keys, name)
+		name := pickKey(query, false)
+		if len(name) == 0 {
+			fmt.Printf("Key %s not found\n", query)
+			continue
+		}
+		if name != query && !confirm(fmt.Sprintf("Delete %s", name)) {
+			continue
+		}
+		db.Delete(name)
 	}
 
 	saveDBFile()
 }
 
+// saveDBFile backs up the db file and atomically replaces it with the
+// encrypted keys, unless another process changed it since it was loaded.
 func saveDBFile() {
-	f, err := os.Create(dbpath)
-	if err != nil {
-		exitOnError(fmt.Sprintf("Failed to create file %s", dbpath))
-	} else {
-		os.Chmod(dbpath, 0600)
-	}
-
-	defer f.Close()
-
-	w := bufio.NewWriter(f)
-	w.Write(iv)
-	if serializedKeys, err := json.Marshal(keys); err != nil {
-		exitOnError(fmt.Sprintf("Failed to marshal: %s", err.Error()))
-	} else {
-		encrypted, _ := encrypt(serializedKeys, cryptokey, iv)
-		w.Write(encrypted)
+	lockDBFile()
+	if err := db.Save(); err != nil {
+		exitOnError(err.Error())
 	}
-	w.Flush()
 }
 
+// loadDBFile opens the db file and decrypts it with the key held by the
+// agent or, if there is none or it is outdated, with the key derived from
+// the passphrase or, for a team vault, with the data key unwrapped by the
+// local identity.
 func loadDBFile() {
-	content, err := ioutil.ReadFile(dbpath)
-	if err != nil {
+	var err error
+	if db, err = vault.OpenStore(mustOpenStore()); err == vault.ErrNotFound {
+		exitOnError(fmt.Sprintf("Keybox file %s does not exit. Use create command to create one", dbpath))
+	} else if err != nil {
 		exitOnError(err.Error())
 	}
 
-	if len(content) < aes.BlockSize {
-		exitOnError("File corrupted")
-	}
-
-	iv := content[:aes.BlockSize]
-	serializedKeys, err := decrypt(content[aes.BlockSize:], cryptokey, iv)
-	if err != nil {
-		exitOnError("File corrupted")
+	if db.Version() == vault.FormatV1 {
+		loadV1DBFile()
+		return
 	}
 
-	if err := json.Unmarshal(serializedKeys, &keys); err != nil {
-		exitOnError("Wrong password")
+	if err = unlockVault(db); err != nil {
+		exitOnError(err.Error())
 	}
 }
 
-func encrypt(plaintext, key, iv []byte) (ciphertext []byte, err error) {
-	// CBC mode works on blocks so plaintexts may need to be padded to the
-	// next whole block. For an example of such padding, see
-	// https://tools.ietf.org/html/rfc5246#section-6.2.3.2.
-	for i := len(plaintext) % aes.BlockSize; i < aes.BlockSize; i++ {
-		plaintext = append(plaintext, byte(0))
+// unlockVault unlocks v with the key cached in the agent, the team
+// identities or the passphrase. The key is cached unless it came from the
+// agent.
+func unlockVault(v *vault.Vault) error {
+	err := vault.ErrWrongPassword
+	if k := agentKey(); k != nil && cachedPassphrase == nil && !passphraseGiven() {
+		err = v.UnlockKey(k)
 	}
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return
+	if err != vault.ErrWrongPassword {
+		return err
 	}
 
-	ciphertext = make([]byte, len(plaintext))
-	mode := cipher.NewCBCEncrypter(block, iv)
-	mode.CryptBlocks(ciphertext, plaintext)
-
-	// It's important to remember that ciphertexts must be authenticated
-	// (i.e. by using crypto/hmac) as well as being encrypted in order to
-	// be secure.
-
-	return
+	if v.Team() {
+		var ids []age.Identity
+		if ids, err = loadIdentities(); err == nil {
+			err = v.UnlockIdentities(ids...)
+		}
+	} else {
+		for try := 1; ; try++ {
+			err = v.Unlock(readPassphrase())
+			if !retryPassphrase(err, try) {
+				break
+			}
+		}
+	}
+	if err == nil {
+		agentPutKey(v.Key())
+	}
+	return err
 }
 
-func decrypt(ciphertext, key, iv []byte) (plaintext []byte, err error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return
+// loadV1DBFile reads a file written before the v2 format and offers to
+// upgrade it in place to the current format. The old file is kept next to it
+// with a .v1 suffix. Declined, the vault cannot be saved, see
+// vault.ErrUpgrade.
+func loadV1DBFile() {
+	for try := 1; ; try++ {
+		err := db.Unlock(readPassphrase())
+		if err == vault.ErrCorrupted {
+			exitOnError("File corrupted")
+		}
+		if !retryPassphrase(err, try) {
+			if err != nil {
+				exitOnError(err.Error())
+			}
+			break
+		}
 	}
+	passphrase := readPassphrase()
 
-	// CBC mode always works in whole blocks.
-	if len(ciphertext)%aes.BlockSize != 0 {
-		err = errors.New("ciphertext is not a multiple of the block size")
+	if !confirm(fmt.Sprintf("Keybox file uses the old v1 format, upgrade it to v%d", vault.FormatV3)) {
 		return
 	}
 
-	mode := cipher.NewCBCDecrypter(block, iv)
-
-	// CryptBlocks can work in-place if the two arguments are the same.
-	plaintext = make([]byte, len(ciphertext))
-	mode.CryptBlocks(plaintext, ciphertext)
-
-	i := len(plaintext) - 1
-	for ; i > 0 && plaintext[i-1] == 0; i-- {
+	if err := ioutil.WriteFile(dbpath+".v1", db.Content(), 0600); err != nil {
+		exitOnError(fmt.Sprintf("Cannot save to file %s.v1: %s", dbpath, err))
 	}
 
-	plaintext = plaintext[:i]
-	//However, it's critical to note that ciphertexts must be authenticated (i.e. by
-	// using crypto/hmac) before being decrypted in order to avoid creating
-	// a padding oracle.
-
-	return
+	p, err := vault.NewKDFParams(vault.KDFArgon2id)
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	if err := db.SetPassphrase(passphrase, p); err != nil {
+		exitOnError(err.Error())
+	}
+	db.LogOp("upgrade", fmt.Sprintf("v1 to v%d", vault.FormatV3))
+	saveDBFile()
+	fmt.Printf("Upgraded, the v1 file is kept as %s.v1\n", dbpath)
 }
 
 func promptForKey() *key {
 	name := getPromptedInput("Name")
+	if len(name) == 0 {
+		return nil
+	}
+	// an existing key to overwrite, or a new one
+	if name = pickKey(name, true); len(name) == 0 {
+		return nil
+	}
 	login := getPromptedInput("Login")
-	password := getPromptedInput("Password (auto generated by enter)")
+	password := getSecretInput("Password (auto generated by enter)")
 
 	if len(name) > 0 && len(login) > 0 {
 		if len(password) == 0 {
 			password = newPassword()
 		}
-		return &key{name, login, password}
+		url := getPromptedInput("URL (optional)")
+		tags := parseTags(getPromptedInput("Tags (comma separated, optional)"))
+		return &key{Name: name, Login: login, Password: password, URL: url, Tags: tags}
 	}
 
 	return nil
 }
 
+func confirm(prompt string) bool {
+	answer := strings.ToLower(getPromptedInput(prompt + " [y/N]"))
+	return answer == "y" || answer == "yes"
+}
+
+// getPromptedInput prints the prompt to stderr so that the output of the
+// scripting commands stays clean. It returns "" at the end of the input.
 func getPromptedInput(prompt string) string {
-	fmt.Printf("%s: ", prompt)
-	input, _ := bufio.NewReader(os.Stdin).ReadString('\n')
-	return input[:len(input)-1]
+	input, _ := readInput(prompt, false)
+	return input
+}
+
+// getSecretInput is getPromptedInput without echoing what is typed.
+func getSecretInput(prompt string) string {
+	input, _ := readInput(prompt, true)
+	return input
 }
 
-func newPassword() string {
-	// 3 of each: lowercase, uppercase, special letters and numbers
-	specialties := [...]byte{'!', '@', '#', '$', '%', '^', '&', '*', '(', ')', '?', '+', '~'}
+// readInput reads a line after the prompt, without the line ending. When
+// secret is set and stdin is a terminal the echo is turned off, otherwise
+// the line is read as is. io.EOF is returned when there is nothing left to
+// read, e.g. after Ctrl-D.
+func readInput(prompt string, secret bool) (string, error) {
+	fmt.Fprintf(os.Stderr, "%s: ", prompt)
 
-	mrand.Seed(int64(time.Now().Nanosecond()))
-	p := make([]byte, 0, 12)
+	fd := int(os.Stdin.Fd())
+	if secret && term.IsTerminal(fd) {
+		return readHidden(fd)
+	}
 
-	for len(p) <= cap(p)-4 {
-		p = append(p,
-			byte(int('A')+mrand.Intn(26)), // A-Z
-			byte(int('a')+mrand.Intn(26)), // a-z
-			byte(int('0')+mrand.Intn(10)), // 0-9
-			specialties[mrand.Intn(len(specialties))])
+	input, err := stdin.ReadString('\n')
+	if err == io.EOF && len(input) == 0 {
+		fmt.Fprintln(os.Stderr)
+		return "", err
+	}
+	return strings.TrimRight(input, "\r\n"), nil
+}
+
+// readHidden reads a line from the terminal with the echo off. The terminal
+// is put back if the read is interrupted.
+func readHidden(fd int) (string, error) {
+	state, err := term.GetState(fd)
+	if err != nil {
+		return "", err
 	}
 
-	// shuffle
-	for i := range p {
-		j := mrand.Intn(len(p))
-		if i != j {
-			p[i], p[j] = p[j], p[i]
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	done := make(chan struct{})
+	defer func() {
+		signal.Stop(interrupted)
+		close(done)
+	}()
+	go func() {
+		select {
+		case <-interrupted:
+			term.Restore(fd, state)
+			fmt.Fprintln(os.Stderr)
+			os.Exit(130)
+		case <-done:
 		}
+	}()
+
+	input, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
 	}
+	return strings.TrimRight(string(input), "\r\n"), nil
+}
 
-	return string(p)
+// passphraseGiven reports whether the passphrase comes from -passphrase-fd or
+// the environment rather than from the user.
+func passphraseGiven() bool {
+	return *passphraseFD >= 0 || len(os.Getenv("KEYBOX_PASSPHRASE")) > 0
 }
 
-func setCryptoKey(passphrase string) error {
-	// convert a passphrase to a key, use a suitable
-	// package like bcrypt or scrypt.
-	h := sha256.New()
-	h.Write([]byte(passphrase))
-	//fmt.Printf("crytoKey: %x\n", h.Sum(nil))
-	cryptokey = h.Sum(nil)
-	return nil
+// readPassphrase returns the master password from the -passphrase-fd file
+// descriptor, the KEYBOX_PASSPHRASE environment variable or, failing those,
+// from the prompt. It is read only once per run.
+func readPassphrase() string {
+	if cachedPassphrase != nil {
+		return *cachedPassphrase
+	}
+
+	var p string
+	switch {
+	case *passphraseFD >= 0:
+		p = readPassphraseFD(*passphraseFD)
+	case len(os.Getenv("KEYBOX_PASSPHRASE")) > 0:
+		p = os.Getenv("KEYBOX_PASSPHRASE")
+	default:
+		var err error
+		if p, err = readInput("Password", true); err != nil {
+			exitOnError("No password given")
+		}
+		passphrasePrompted = true
+	}
+
+	cachedPassphrase = &p
+	return p
 }
 
+// readPassphraseFD reads a line from the file descriptor fd, 0 being the
+// standard input.
+func readPassphraseFD(fd int) string {
+	r := stdin
+	if fd != 0 {
+		f := os.NewFile(uintptr(fd), "passphrase")
+		if f == nil {
+			exitOnError(fmt.Sprintf("Invalid passphrase file descriptor %d", fd))
+		}
+		defer f.Close()
+		r = bufio.NewReader(f)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		exitOnError(fmt.Sprintf("Cannot read passphrase: %s", err))
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// retryPassphrase reports whether to prompt for the passphrase again after
+// the try-th attempt failed with err. Only a typed passphrase is retried.
+func retryPassphrase(err error, try int) bool {
+	if err != vault.ErrWrongPassword || !passphrasePrompted || try >= maxPassphraseTries {
+		return false
+	}
+	fmt.Fprintln(os.Stderr, "Wrong password, try again")
+	cachedPassphrase = nil
+	return true
+}
+
+// onExit is run by exitOnError before exiting, e.g. to restore the terminal.
+var onExit func()
+
 func exitOnError(err string) {
+	if onExit != nil {
+		onExit()
+	}
+	closeStores()
 	red := color.New(color.FgRed)
 	red.Println(err)
 	os.Exit(1)
@@ -1,35 +1,58 @@
 package main
 
 import (
-	"crypto/aes"
-	crand "crypto/rand"
-	"crypto/sha256"
+	"bufio"
 	"io"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/goofy-coder/Go/keybox/vault"
 )
 
-func TestEncryptDescrypt(t *testing.T) {
-	h := sha256.New()
-	h.Write([]byte("my secretes"))
-	cryptokey = h.Sum(nil)
-	iv := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(crand.Reader, iv); err != nil {
-		t.Errorf("iv initialization error: %s", err)
+// useKeys replaces the loaded vault with a new one holding ks.
+func useKeys(t *testing.T, ks ...key) {
+	v, err := vault.Create(vault.NewFileStore(filepath.Join(t.TempDir(), "vault")), &vault.KDFParams{KDF: vault.KDFSHA256}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range ks {
+		v.Store(k)
 	}
+	db = v
+}
 
-	original := "hello world!"
-	ciphertext, err := encrypt([]byte(original), cryptokey, iv)
-	if err != nil {
-		t.Errorf("Encrytpion error: %s", err)
+func TestGetPromptedInput(t *testing.T) {
+	defer func(r *bufio.Reader) { stdin = r }(stdin)
+	stdin = bufio.NewReader(strings.NewReader("unix\nwindows\r\nlast"))
+
+	for _, want := range []string{"unix", "windows", "last", "", ""} {
+		if got := getPromptedInput("Name"); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
 	}
+	if _, err := readInput("Name", true); err != io.EOF {
+		t.Errorf("secret input at EOF: got %v, want EOF", err)
+	}
+}
 
-	decrypted, err := decrypt(ciphertext, cryptokey, iv)
-	if err != nil {
-		t.Errorf("Decrypt error: %s", err)
+func TestRetryPassphrase(t *testing.T) {
+	defer func() { passphrasePrompted, cachedPassphrase = false, nil }()
+	p := "typed"
+
+	passphrasePrompted, cachedPassphrase = false, &p
+	if retryPassphrase(vault.ErrWrongPassword, 1) {
+		t.Error("retried a passphrase that was not typed")
 	}
 
-	if string(decrypted) != original {
-		t.Errorf("%d %d", len(string(decrypted)), len(original))
-		t.Errorf("\"%s\" != \"%s\"", string(decrypted), original)
+	passphrasePrompted = true
+	if !retryPassphrase(vault.ErrWrongPassword, 1) || cachedPassphrase != nil {
+		t.Error("typed passphrase not retried")
+	}
+	if retryPassphrase(vault.ErrWrongPassword, maxPassphraseTries) {
+		t.Error("retried past the limit")
+	}
+	if retryPassphrase(vault.ErrTampered, 1) || retryPassphrase(nil, 1) {
+		t.Error("retried on another error")
 	}
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+)
+
+// Processes that modify the db file take the lock of the vault before
+// loading it and hold it until they exit, see vault.Lock. Remote vaults have
+// no lock, their version tokens keep the writers from overwriting each other.
+
+// locks are the locks held, by db file
+var locks = make(map[string]io.Closer)
+
+// lockDBFile takes the lock of the db file, waiting for it with -wait. It
+// does nothing if the lock is held already.
+func lockDBFile() {
+	path := localPath(dbpath)
+	if locks[dbpath] != nil || len(path) == 0 {
+		return
+	}
+
+	waiting := false
+	for {
+		l, err := vault.Lock(path)
+		if err == nil {
+			locks[dbpath] = l
+			return
+		}
+		if err != vault.ErrLocked {
+			exitOnError(fmt.Sprintf("Cannot lock %s: %s", dbpath, err))
+		}
+		if !*wait {
+			exitOnError(fmt.Sprintf("Vault is locked by %s, use -wait to wait for it", vault.LockOwner(path)))
+		}
+		if !waiting {
+			fmt.Fprintf(os.Stderr, "Vault is locked by %s, waiting...\n", vault.LockOwner(path))
+			waiting = true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+)
+
+// showOTP prints the current code of a key. Setting the secret is done with
+// -uri or with -secret and the parameter flags.
+func showOTP(args []string) {
+	fs := flag.NewFlagSet("otp", flag.ExitOnError)
+	uri := fs.String("uri", "", "set the secret from an otpauth:// URI")
+	secret := fs.String("secret", "", "set a TOTP secret given in base32")
+	algorithm := fs.String("algorithm", "SHA1", "algorithm for -secret: SHA1, SHA256 or SHA512")
+	digits := fs.Int("digits", 6, "number of digits for -secret")
+	period := fs.Int("period", 30, "period in seconds for -secret")
+	remove := fs.Bool("remove", false, "remove the OTP secret from the key")
+	names := parseInterspersed(fs, args)
+	if len(names) != 1 {
+		exitOnError("Usage: keybox otp <name> [-uri otpauth://... | -secret base32 [-algorithm SHA1] [-digits 6] [-period 30] | -remove]")
+	}
+
+	// locked even to show a code, as a HOTP code moves its counter on
+	lockDBFile()
+	loadDBFile()
+
+	k, found := db.Get(names[0])
+	if !found {
+		exitOnError(fmt.Sprintf("Key %s not found", names[0]))
+	}
+
+	if len(*uri) > 0 || len(*secret) > 0 || *remove {
+		k.OTP = nil
+		if len(*uri) > 0 {
+			o, err := vault.ParseOTPURI(*uri)
+			if err != nil {
+				exitOnError(err.Error())
+			}
+			k.OTP = o
+		} else if len(*secret) > 0 {
+			k.OTP = &vault.OTP{Type: "totp", Secret: *secret, Algorithm: strings.ToUpper(*algorithm), Digits: *digits, Period: *period}
+			if err := k.OTP.Validate(); err != nil {
+				exitOnError(err.Error())
+			}
+		}
+		db.Put(k)
+
+		saveDBFile()
+		return
+	}
+
+	if k.OTP == nil {
+		exitOnError(fmt.Sprintf("Key %s has no OTP secret", k.Name))
+	}
+
+	code, valid, err := k.OTP.Code(time.Now())
+	if err != nil {
+		exitOnError(err.Error())
+	}
+
+	if k.OTP.Type == "hotp" {
+		// every code is used once, move on to the next one before it is shown
+		k.OTP.Counter++
+		db.Put(k)
+
+		saveDBFile()
+		fmt.Println(code)
+		return
+	}
+	fmt.Println(code)
+	fmt.Fprintf(os.Stderr, "valid for %ds\n", int(valid.Seconds()))
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	crand "crypto/rand"
+	_ "embed"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// eff_large_wordlist.txt is the EFF large wordlist for five dice,
+// https://www.eff.org/files/2016/07/18/eff_large_wordlist.txt
+//
+//go:embed eff_large_wordlist.txt
+var effWordlist string
+
+var wordlist []string
+
+const (
+	lowerChars     = "abcdefghijklmnopqrstuvwxyz"
+	upperChars     = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digitChars     = "0123456789"
+	symbolChars    = "!@#$%^&*()?+~"
+	ambiguousChars = "0Oo1lI"
+
+	maxWords = 64
+)
+
+// passwordPolicy describes how to generate a password. A policy with Words
+// set generates a diceware passphrase and ignores the character options.
+type passwordPolicy struct {
+	Length           int
+	Lower            bool
+	Upper            bool
+	Digits           bool
+	Symbols          bool
+	ExcludeAmbiguous bool
+	MinPerClass      int
+
+	Words      int
+	Separator  string
+	Capitalize bool
+}
+
+// passwordPresets are policies for common site rules.
+var passwordPresets = map[string]passwordPolicy{
+	"default":    {Length: 16, Lower: true, Upper: true, Digits: true, Symbols: true, MinPerClass: 1},
+	"legacy":     {Length: 12, Lower: true, Upper: true, Digits: true, Symbols: true, MinPerClass: 3},
+	"strong":     {Length: 32, Lower: true, Upper: true, Digits: true, Symbols: true, MinPerClass: 2},
+	"alnum":      {Length: 20, Lower: true, Upper: true, Digits: true, MinPerClass: 1},
+	"readable":   {Length: 16, Lower: true, Upper: true, Digits: true, ExcludeAmbiguous: true, MinPerClass: 1},
+	"bank":       {Length: 8, Lower: true, Upper: true, Digits: true, ExcludeAmbiguous: true, MinPerClass: 1},
+	"pin":        {Length: 6, Digits: true},
+	"passphrase": {Words: 6, Separator: "-"},
+}
+
+func (p passwordPolicy) classes() []string {
+	var classes []string
+	for _, c := range []struct {
+		enabled bool
+		chars   string
+	}{{p.Lower, lowerChars}, {p.Upper, upperChars}, {p.Digits, digitChars}, {p.Symbols, symbolChars}} {
+		if !c.enabled {
+			continue
+		}
+		if p.ExcludeAmbiguous {
+			c.chars = strings.Map(func(r rune) rune {
+				if strings.ContainsRune(ambiguousChars, r) {
+					return -1
+				}
+				return r
+			}, c.chars)
+		}
+		classes = append(classes, c.chars)
+	}
+	return classes
+}
+
+func (p passwordPolicy) validate() error {
+	if p.Words > 0 {
+		if p.Words > maxWords {
+			return fmt.Errorf("Invalid number of words %d", p.Words)
+		}
+		return nil
+	}
+
+	classes := p.classes()
+	if len(classes) == 0 {
+		return errors.New("No character class selected")
+	}
+	if p.Length < 1 || p.Length > 1024 {
+		return fmt.Errorf("Invalid password length %d", p.Length)
+	}
+	if p.MinPerClass*len(classes) > p.Length {
+		return fmt.Errorf("Length %d is too short for %d characters of each of %d classes", p.Length, p.MinPerClass, len(classes))
+	}
+	return nil
+}
+
+// generatePassword generates a password or passphrase following p with
+// crypto/rand.
+func generatePassword(p passwordPolicy) (string, error) {
+	if err := p.validate(); err != nil {
+		return "", err
+	}
+
+	if p.Words > 0 {
+		return generatePassphrase(p)
+	}
+
+	classes := p.classes()
+	all := strings.Join(classes, "")
+	pw := make([]byte, 0, p.Length)
+	for _, chars := range classes {
+		for i := 0; i < p.MinPerClass; i++ {
+			c, err := randomChoice(chars)
+			if err != nil {
+				return "", err
+			}
+			pw = append(pw, c)
+		}
+	}
+	for len(pw) < p.Length {
+		c, err := randomChoice(all)
+		if err != nil {
+			return "", err
+		}
+		pw = append(pw, c)
+	}
+
+	// Fisher-Yates, so that the required characters are not up front
+	for i := len(pw) - 1; i > 0; i-- {
+		j, err := randomInt(i + 1)
+		if err != nil {
+			return "", err
+		}
+		pw[i], pw[j] = pw[j], pw[i]
+	}
+
+	return string(pw), nil
+}
+
+func generatePassphrase(p passwordPolicy) (string, error) {
+	words := make([]string, p.Words)
+	for i := range words {
+		n, err := randomInt(len(loadWordlist()))
+		if err != nil {
+			return "", err
+		}
+		words[i] = wordlist[n]
+		if p.Capitalize {
+			r := []rune(words[i])
+			r[0] = unicode.ToUpper(r[0])
+			words[i] = string(r)
+		}
+	}
+	return strings.Join(words, p.Separator), nil
+}
+
+func loadWordlist() []string {
+	if wordlist == nil {
+		s := bufio.NewScanner(strings.NewReader(effWordlist))
+		for s.Scan() {
+			// dice rolls, tab, word
+			if f := strings.Fields(s.Text()); len(f) == 2 {
+				wordlist = append(wordlist, f[1])
+			}
+		}
+	}
+	return wordlist
+}
+
+func randomInt(n int) (int, error) {
+	i, err := crand.Int(crand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+	return int(i.Int64()), nil
+}
+
+func randomChoice(chars string) (byte, error) {
+	i, err := randomInt(len(chars))
+	if err != nil {
+		return 0, err
+	}
+	return chars[i], nil
+}
+
+// newPassword generates a password with the default policy.
+func newPassword() string {
+	pw, err := generatePassword(passwordPresets["default"])
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	return pw
+}
+
+func createPassword(args []string) {
+	fs := flag.NewFlagSet("createpassword", flag.ExitOnError)
+	preset := fs.String("preset", "default", "policy preset: "+strings.Join(presetNames(), ", "))
+	fs.Int("length", 0, "password length")
+	fs.Bool("lower", false, "use lowercase letters")
+	fs.Bool("upper", false, "use uppercase letters")
+	fs.Bool("digits", false, "use digits")
+	fs.Bool("symbols", false, "use symbols "+symbolChars)
+	fs.Bool("no-ambiguous", false, "exclude the ambiguous characters "+ambiguousChars)
+	fs.Int("min-per-class", 0, "minimum number of characters of each selected class")
+	fs.Int("words", 0, "generate a diceware passphrase of this many words")
+	separator := fs.String("separator", "-", "separator between the words of a passphrase")
+	fs.Bool("capitalize", false, "capitalize the words of a passphrase")
+	count := fs.Int("n", 1, "number of passwords to generate")
+	fs.Parse(args)
+
+	p, found := passwordPresets[*preset]
+	if !found {
+		exitOnError(fmt.Sprintf("Unknown preset %s, expected one of %s", *preset, strings.Join(presetNames(), ", ")))
+	}
+
+	// a passphrase asked of a character preset gets the default separator
+	if p.Words == 0 {
+		p.Separator = *separator
+	}
+	// flags given explicitly override the preset
+	fs.Visit(func(f *flag.Flag) {
+		v := f.Value.String()
+		switch f.Name {
+		case "length":
+			p.Length, _ = strconv.Atoi(v)
+		case "lower":
+			p.Lower = v == "true"
+		case "upper":
+			p.Upper = v == "true"
+		case "digits":
+			p.Digits = v == "true"
+		case "symbols":
+			p.Symbols = v == "true"
+		case "no-ambiguous":
+			p.ExcludeAmbiguous = v == "true"
+		case "min-per-class":
+			p.MinPerClass, _ = strconv.Atoi(v)
+		case "words":
+			p.Words, _ = strconv.Atoi(v)
+		case "separator":
+			p.Separator = v
+		case "capitalize":
+			p.Capitalize = v == "true"
+		}
+	})
+
+	for i := 0; i < *count; i++ {
+		pw, err := generatePassword(p)
+		if err != nil {
+			exitOnError(err.Error())
+		}
+		fmt.Println(pw)
+	}
+}
+
+func presetNames() []string {
+	names := make([]string, 0, len(passwordPresets))
+	for name := range passwordPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
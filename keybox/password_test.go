@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratePassword(t *testing.T) {
+	for name, p := range passwordPresets {
+		pw, err := generatePassword(p)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		if p.Words > 0 {
+			if n := len(strings.Split(pw, p.Separator)); n != p.Words {
+				t.Errorf("%s: %d words in %s", name, n, pw)
+			}
+			continue
+		}
+
+		if len(pw) != p.Length {
+			t.Errorf("%s: length %d != %d", name, len(pw), p.Length)
+		}
+		for _, chars := range p.classes() {
+			n := 0
+			for _, c := range pw {
+				if strings.ContainsRune(chars, c) {
+					n++
+				}
+			}
+			if n < p.MinPerClass {
+				t.Errorf("%s: %s has %d of %s", name, pw, n, chars)
+			}
+		}
+		if p.ExcludeAmbiguous && strings.ContainsAny(pw, ambiguousChars) {
+			t.Errorf("%s: %s has ambiguous characters", name, pw)
+		}
+	}
+}
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	for _, p := range []passwordPolicy{
+		{Length: 8},
+		{Length: 0, Digits: true},
+		{Length: 3, Lower: true, Upper: true, MinPerClass: 2},
+		{Words: maxWords + 1},
+	} {
+		if _, err := generatePassword(p); err == nil {
+			t.Errorf("%+v: expected an error", p)
+		}
+	}
+}
+
+func TestWordlist(t *testing.T) {
+	if n := len(loadWordlist()); n != 6*6*6*6*6 {
+		t.Errorf("wordlist has %d words", n)
+	}
+}
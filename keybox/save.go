@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+)
+
+// backupCount is the number of backups to keep, from KEYBOX_BACKUPS.
+func backupCount() int {
+	if s := os.Getenv("KEYBOX_BACKUPS"); len(s) > 0 {
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return vault.DefaultBackups
+}
+
+// restoreDBFile lists the backups and restores the one picked by number,
+// given as argument or at the prompt. The current file is backed up first,
+// so a restore can be undone.
+func restoreDBFile(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	list := fs.Bool("list", false, "only list the backups")
+	fs.Parse(args)
+
+	if !isVaultFile(dbpath) {
+		exitOnError("Backups are only kept of vault files")
+	}
+	backups, err := vault.Backups(dbpath)
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	if len(backups) == 0 {
+		exitOnError(fmt.Sprintf("No backups of %s", dbpath))
+	}
+
+	choice := fs.Arg(0)
+	if len(choice) == 0 || *list {
+		for i, b := range backups {
+			modified := ""
+			if finfo, err := os.Stat(b); err == nil {
+				modified = finfo.ModTime().Format(time.RFC3339)
+			}
+			fmt.Printf("%3d  %-25s %s\n", i+1, modified, filepath.Base(b))
+		}
+		if *list {
+			return
+		}
+		choice = getPromptedInput("Backup to restore (enter to cancel)")
+		if len(choice) == 0 {
+			return
+		}
+	}
+
+	i, err := strconv.Atoi(choice)
+	if err != nil || i < 1 || i > len(backups) {
+		exitOnError(fmt.Sprintf("Invalid backup number %s", choice))
+	}
+
+	lockDBFile()
+
+	content, err := ioutil.ReadFile(backups[i-1])
+	if err != nil {
+		exitOnError(fmt.Sprintf("Restore failed: %s", err))
+	}
+	checkAttachments(content, backups[i-1])
+	if err := vault.Backup(dbpath, backupCount()); err != nil {
+		exitOnError(fmt.Sprintf("Cannot back up %s: %s", dbpath, err))
+	}
+	if err := vault.WriteFileAtomic(dbpath, content, 0600); err != nil {
+		exitOnError(fmt.Sprintf("Restore failed: %s", err))
+	}
+	fmt.Printf("Restored %s\n", filepath.Base(backups[i-1]))
+}
+
+// checkAttachments exits if the vault file content of backup refers to
+// attachments that are no longer in the store, as restoring it would lose
+// them.
+func checkAttachments(content []byte, backup string) {
+	v, err := vault.Load(content)
+	if err != nil {
+		exitOnError(fmt.Sprintf("Cannot open %s: %s", filepath.Base(backup), err))
+	}
+	// v1 files have no attachments
+	if v.Version() == vault.FormatV1 {
+		return
+	}
+	if err := unlockVault(v); err != nil {
+		exitOnError(fmt.Sprintf("Cannot open %s: %s", filepath.Base(backup), err))
+	}
+	missing, err := v.MissingAttachments(mustOpenStore())
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	if len(missing) > 0 {
+		exitOnError(fmt.Sprintf("Backup %s refers to attachments missing from %s: %s", filepath.Base(backup), dbpath, strings.Join(missing, ", ")))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var fieldTypes = []string{"text", "hidden", "url"}
+
+// keyField returns the value of a built-in or custom field by name.
+func keyField(k key, name string) (string, bool) {
+	switch name {
+	case "login":
+		return k.Login, true
+	case "password":
+		return k.Password, true
+	case "url":
+		return k.URL, true
+	case "notes":
+		return k.Notes, true
+	case "tags":
+		return strings.Join(k.Tags, ","), true
+	}
+
+	for _, f := range k.Fields {
+		if f.Name == name {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// parseField parses "name=value" or "name:type=value".
+func parseField(s string) (field, error) {
+	nameType, value, found := strings.Cut(s, "=")
+	if !found || len(nameType) == 0 {
+		return field{}, fmt.Errorf("Invalid field %q, expected name[:type]=value", s)
+	}
+
+	f := field{Name: nameType, Type: "text", Value: value}
+	if name, t, found := strings.Cut(nameType, ":"); found {
+		f.Name, f.Type = name, t
+	}
+
+	for _, t := range fieldTypes {
+		if f.Type == t {
+			return f, nil
+		}
+	}
+	return field{}, fmt.Errorf("Invalid field type %s, expected one of %s", f.Type, strings.Join(fieldTypes, ", "))
+}
+
+// parseTags splits a comma separated list of tags.
+func parseTags(s string) []string {
+	var tags []string
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); len(t) > 0 {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// fieldList collects repeated -field flags.
+type fieldList []field
+
+func (l *fieldList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *fieldList) Set(s string) error {
+	f, err := parseField(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, f)
+	return nil
+}
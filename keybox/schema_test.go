@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseField(t *testing.T) {
+	for s, want := range map[string]field{
+		"pin=1234":                    {Name: "pin", Type: "text", Value: "1234"},
+		"recovery:hidden=a=b":         {Name: "recovery", Type: "hidden", Value: "a=b"},
+		"admin:url=https://x.example": {Name: "admin", Type: "url", Value: "https://x.example"},
+	} {
+		if f, err := parseField(s); err != nil || f != want {
+			t.Errorf("%s: got %+v, %v", s, f, err)
+		}
+	}
+
+	for _, s := range []string{"novalue", "=x", "a:secret=x"} {
+		if _, err := parseField(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+)
+
+// Non-interactive commands for shell scripts and CI jobs. They never prompt
+// for anything but the passphrase, see readPassphrase, print nothing but the
+// requested value on stdout and exit with a non-zero status on error.
+
+func getKey(args []string) {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	field := fs.String("field", "password", "field to print: login, password, url, notes, tags or a custom field")
+	asJSON := fs.Bool("json", false, "print the whole key as JSON")
+	names := parseInterspersed(fs, args)
+	if len(names) != 1 {
+		exitOnError("Usage: keybox get <name> [-field name] [-json]")
+	}
+
+	loadDBFile()
+
+	k, found := db.Get(names[0])
+	if !found {
+		exitOnError(fmt.Sprintf("Key %s not found", names[0]))
+	}
+
+	if *asJSON {
+		printJSON(k)
+		return
+	}
+
+	v, found := keyField(k, *field)
+	if !found {
+		exitOnError(fmt.Sprintf("Unknown field %s", *field))
+	}
+	fmt.Println(v)
+}
+
+func setKey(args []string) {
+	fs := flag.NewFlagSet("set", flag.ExitOnError)
+	login := fs.String("login", "", "login of the key, required for a new key")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from the first line of stdin instead of generating one")
+	generate := fs.Bool("generate", false, "generate a new password for an existing key")
+	preset := fs.String("preset", "default", "password policy preset used to generate the password")
+	url := fs.String("url", "", "URL of the service")
+	notes := fs.String("notes", "", "free form notes")
+	tags := fs.String("tags", "", "comma separated tags, replaces the current ones")
+	otpURI := fs.String("otp", "", "otpauth:// URI of the TOTP or HOTP secret")
+	var fields fieldList
+	fs.Var(&fields, "field", "custom field as name[:text|hidden|url]=value, repeatable")
+	names := parseInterspersed(fs, args)
+	if len(names) != 1 {
+		exitOnError("Usage: keybox set <name> [-login login] [-password-stdin | -generate] [-preset name] [-url url] [-notes notes] [-tags a,b] [-field name:type=value]... [-otp otpauth://...]")
+	}
+
+	// read the passphrase first, it may come from stdin as well
+	lockDBFile()
+	loadDBFile()
+
+	k, found := db.Get(names[0])
+	if !found {
+		if len(*login) == 0 {
+			exitOnError(fmt.Sprintf("Key %s not found, -login is required for a new key", names[0]))
+		}
+		k.Name = names[0]
+	}
+	if len(*login) > 0 {
+		k.Login = *login
+	}
+	if len(*url) > 0 {
+		k.URL = *url
+	}
+	if len(*notes) > 0 {
+		k.Notes = *notes
+	}
+	if len(*tags) > 0 {
+		k.Tags = parseTags(*tags)
+	}
+	for _, f := range fields {
+		k.SetField(f)
+	}
+	if len(*otpURI) > 0 {
+		o, err := vault.ParseOTPURI(*otpURI)
+		if err != nil {
+			exitOnError(err.Error())
+		}
+		k.OTP = o
+	}
+
+	if *passwordStdin {
+		line, err := stdin.ReadString('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			exitOnError(fmt.Sprintf("Cannot read password: %s", err))
+		}
+		k.Password = strings.TrimRight(line, "\r\n")
+	} else if !found || *generate {
+		p, found := passwordPresets[*preset]
+		if !found {
+			exitOnError(fmt.Sprintf("Unknown preset %s, expected one of %s", *preset, strings.Join(presetNames(), ", ")))
+		}
+		pw, err := generatePassword(p)
+		if err != nil {
+			exitOnError(err.Error())
+		}
+		k.Password = pw
+	}
+
+	if len(k.Password) == 0 {
+		exitOnError("Empty password")
+	}
+
+	db.Put(k)
+
+	saveDBFile()
+}
+
+func removeKeys(args []string) {
+	if len(args) == 0 {
+		exitOnError("Usage: keybox rm <name>...")
+	}
+
+	lockDBFile()
+	loadDBFile()
+
+	for _, name := range args {
+		if !db.Delete(name) {
+			exitOnError(fmt.Sprintf("Key %s not found", name))
+		}
+	}
+
+	saveDBFile()
+}
+
+// parseInterspersed parses flags that come before or after the positional
+// arguments, so that both "get -field login name" and "get name -field login"
+// work. It returns the positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		exitOnError(err.Error())
+	}
+}
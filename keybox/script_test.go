@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestParseInterspersed(t *testing.T) {
+	for _, args := range [][]string{
+		{"-field", "login", "github"},
+		{"github", "-field", "login"},
+		{"-field=login", "github"},
+	} {
+		fs := flag.NewFlagSet("get", flag.ContinueOnError)
+		field := fs.String("field", "password", "")
+		names := parseInterspersed(fs, args)
+		if !reflect.DeepEqual(names, []string{"github"}) || *field != "login" {
+			t.Errorf("%v: names %v, field %s", args, names, *field)
+		}
+	}
+}
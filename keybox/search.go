@@ -0,0 +1,231 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxPicks is how many matches pickKey offers to choose from.
+const maxPicks = 20
+
+// keyFilter narrows a search down, the zero value lets every key through.
+type keyFilter struct {
+	Tag           string
+	OlderThan     time.Duration
+	LoginContains string
+}
+
+func (f keyFilter) match(k key, now time.Time) bool {
+	if len(f.Tag) > 0 && !hasTag(k, f.Tag) {
+		return false
+	}
+	if f.OlderThan > 0 && now.Sub(k.Modified) < f.OlderThan {
+		return false
+	}
+	if len(f.LoginContains) > 0 && !strings.Contains(strings.ToLower(k.Login), strings.ToLower(f.LoginContains)) {
+		return false
+	}
+	return true
+}
+
+func hasTag(k key, tag string) bool {
+	for _, t := range k.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// fuzzyScore scores how well query matches text, ignoring case. The
+// characters of query have to appear in text in order. Runs of consecutive
+// characters and matches at the start of a word score higher, and a
+// substring beats any scattered match. 0 means no match.
+func fuzzyScore(query, text string) int {
+	q := []rune(strings.ToLower(query))
+	t := []rune(strings.ToLower(text))
+	if len(q) == 0 {
+		return 1
+	}
+
+	// a substring scores as one run, at its best place
+	best := 0
+	for i := 0; i+len(q) <= len(t); i++ {
+		if string(t[i:i+len(q)]) != string(q) {
+			continue
+		}
+		score := len(q)*(len(q)+1)/2 + 2*len(q)
+		if wordStart(t, i) {
+			score += 2
+		}
+		if len(q) == len(t) {
+			score += 2 * len(q)
+		}
+		if score > best {
+			best = score
+		}
+	}
+	if best > 0 {
+		return best
+	}
+
+	score, qi, run := 0, 0, 0
+	for i := 0; i < len(t) && qi < len(q); i++ {
+		if t[i] != q[qi] {
+			run = 0
+			continue
+		}
+		run++
+		score += run
+		if wordStart(t, i) {
+			score += 2
+		}
+		qi++
+	}
+	if qi < len(q) {
+		return 0
+	}
+	return score
+}
+
+func wordStart(t []rune, i int) bool {
+	return i == 0 || !unicode.IsLetter(t[i-1]) && !unicode.IsDigit(t[i-1])
+}
+
+// keyScore is the best score of query on the name, login, URL and tags of
+// k. The name counts double.
+func keyScore(query string, k key) int {
+	best := 2 * fuzzyScore(query, k.Name)
+	for _, s := range append([]string{k.Login, k.URL}, k.Tags...) {
+		if score := fuzzyScore(query, s); score > best {
+			best = score
+		}
+	}
+	return best
+}
+
+// searchKeys returns the names of the keys that match query and f, the best
+// matches first. An empty query matches every key.
+func searchKeys(query string, f keyFilter) []string {
+	now := time.Now()
+	scores := make(map[string]int)
+	var names []string
+	for _, k := range db.List() {
+		if !f.match(k, now) {
+			continue
+		}
+		if score := keyScore(query, k); score > 0 {
+			scores[k.Name] = score
+			names = append(names, k.Name)
+		}
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		if scores[names[i]] != scores[names[j]] {
+			return scores[names[i]] > scores[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// parseAge parses a duration that also accepts days, weeks and years, e.g.
+// 90d, 2w or 1y.
+func parseAge(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour}
+	if len(s) > 1 {
+		if u, found := units[s[len(s)-1:]]; found {
+			n, err := strconv.Atoi(s[:len(s)-1])
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("Invalid age %s", s)
+			}
+			return time.Duration(n) * u, nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid age %s", s)
+	}
+	return d, nil
+}
+
+func searchCmd(args []string) {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	tag := fs.String("tag", "", "only keys with this tag")
+	olderThan := fs.String("older-than", "", "only keys not modified for this long, e.g. 90d, 2w, 1y or 720h")
+	loginContains := fs.String("login-contains", "", "only keys whose login contains this")
+	asJSON := fs.Bool("json", false, "print the keys as JSON")
+	reveal := fs.Bool("reveal", false, "show the passwords instead of masking them")
+	query := parseInterspersed(fs, args)
+
+	f := keyFilter{Tag: *tag, LoginContains: *loginContains}
+	if len(*olderThan) > 0 {
+		d, err := parseAge(*olderThan)
+		if err != nil {
+			exitOnError(err.Error())
+		}
+		f.OlderThan = d
+	}
+
+	loadDBFile()
+
+	var list []key
+	for _, name := range searchKeys(strings.Join(query, " "), f) {
+		k, _ := db.Get(name)
+		list = append(list, k)
+	}
+	printKeys(list, *asJSON, *reveal)
+}
+
+// pickKey resolves a name typed by the user. An exact name is taken as is,
+// otherwise the matches are offered to choose from, or taken if there is a
+// single one. With allowNew the query itself can be picked as the name of a
+// new key. It returns "" when nothing matches or the choice is cancelled.
+func pickKey(query string, allowNew bool) string {
+	if _, found := db.Get(query); found {
+		return query
+	}
+
+	matches := searchKeys(query, keyFilter{})
+	if len(matches) == 0 {
+		if allowNew {
+			return query
+		}
+		return ""
+	}
+	if len(matches) == 1 && !allowNew {
+		fmt.Fprintf(os.Stderr, "Matched %s\n", matches[0])
+		return matches[0]
+	}
+
+	if len(matches) > maxPicks {
+		matches = matches[:maxPicks]
+	}
+	if allowNew {
+		fmt.Fprintf(os.Stderr, "%3d  new key %s\n", 0, query)
+	}
+	for i, name := range matches {
+		k, _ := db.Get(name)
+		fmt.Fprintf(os.Stderr, "%3d  %-20s %s\n", i+1, name, k.Login)
+	}
+
+	choice := getPromptedInput("Key number (enter to cancel)")
+	if len(choice) == 0 {
+		return ""
+	}
+	i, err := strconv.Atoi(choice)
+	if err != nil || i < 0 || i > len(matches) || i == 0 && !allowNew {
+		exitOnError(fmt.Sprintf("Invalid key number %s", choice))
+	}
+	if i == 0 {
+		return query
+	}
+	return matches[i-1]
+}
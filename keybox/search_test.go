@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFuzzyScore(t *testing.T) {
+	for _, tc := range []struct {
+		query, text string
+		match       bool
+	}{
+		{"gh", "github", true},
+		{"GH", "github", true},
+		{"gthb", "github", true},
+		{"hg", "github", false},
+		{"gitlab", "github", false},
+		{"", "anything", true},
+	} {
+		if got := fuzzyScore(tc.query, tc.text) > 0; got != tc.match {
+			t.Errorf("fuzzyScore(%q, %q) matches %v, want %v", tc.query, tc.text, got, tc.match)
+		}
+	}
+
+	// exact beats substring beats scattered, word starts beat the middle
+	ordered := []string{"mail", "gmail", "my-mail", "mxaxixl"}
+	if fuzzyScore("mail", ordered[0]) <= fuzzyScore("mail", ordered[1]) {
+		t.Error("exact match does not beat substring")
+	}
+	if fuzzyScore("mail", ordered[2]) <= fuzzyScore("mail", ordered[1]) {
+		t.Error("word start does not beat the middle of a word")
+	}
+	if fuzzyScore("mail", ordered[1]) <= fuzzyScore("mail", ordered[3]) {
+		t.Error("substring does not beat scattered match")
+	}
+}
+
+func TestSearchKeys(t *testing.T) {
+	old := time.Now().Add(-200 * 24 * time.Hour)
+	useKeys(t,
+		key{Name: "github", Login: "me@example.com", Tags: []string{"work"}, Modified: old},
+		key{Name: "gitlab", Login: "me@corp.com", Tags: []string{"work"}, Modified: time.Now()},
+		key{Name: "bank", Login: "12345", URL: "https://bank.example.com", Modified: old},
+		key{Name: "netflix", Login: "family@example.com", Tags: []string{"home"}, Modified: time.Now()},
+	)
+
+	for _, tc := range []struct {
+		query string
+		f     keyFilter
+		want  []string
+	}{
+		{"git", keyFilter{}, []string{"github", "gitlab"}},
+		{"glab", keyFilter{}, []string{"gitlab"}},
+		{"", keyFilter{Tag: "WORK"}, []string{"github", "gitlab"}},
+		{"", keyFilter{OlderThan: 90 * 24 * time.Hour}, []string{"bank", "github"}},
+		{"", keyFilter{LoginContains: "example"}, []string{"github", "netflix"}},
+		{"bank.example", keyFilter{}, []string{"bank"}},
+		{"git", keyFilter{Tag: "home"}, nil},
+	} {
+		if got := searchKeys(tc.query, tc.f); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("searchKeys(%q, %+v) = %v, want %v", tc.query, tc.f, got, tc.want)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"90d":  90 * 24 * time.Hour,
+		"2w":   14 * 24 * time.Hour,
+		"1y":   365 * 24 * time.Hour,
+		"720h": 720 * time.Hour,
+	} {
+		if got, err := parseAge(s); err != nil || got != want {
+			t.Errorf("parseAge(%s) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "d", "xd", "-1d", "soon"} {
+		if _, err := parseAge(s); err == nil {
+			t.Errorf("parseAge(%s) did not fail", s)
+		}
+	}
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+)
+
+// keybox serve lets other tools and browser extensions read the vault over
+// HTTP with JSON, on localhost or on a unix socket only the user can use:
+//
+//	POST /v1/pair      {"Client": "firefox"}        -> {"Token": "..."}
+//	GET  /v1/keys                                   -> [{"Name": ..., "Login": ...}]
+//	GET  /v1/search?q=git&tag=work                  -> [{"Name": ..., "Login": ...}]
+//	GET  /v1/keys/NAME                              -> {"Name": ..., "Password": ...}
+//	POST /v1/generate  {"Preset": "default"}        -> {"Password": "..."}
+//
+// A client pairs once, which has to be approved on the terminal of the
+// server, and sends the token it gets as "Authorization: Bearer TOKEN" from
+// then on. Listing and searching return no secrets. Every read of a key is
+// approved on the terminal, unless the key is on the allow-list of the
+// client. Every request is recorded in the access log.
+
+// apiClient is a paired client, in the config. Only the hash of its token
+// is kept.
+type apiClient struct {
+	TokenHash string
+	Allow     []string `json:",omitempty"` // patterns of the keys read without asking
+	Paired    time.Time
+}
+
+// apiKey is a key as the API returns it. The secrets are only filled in
+// when a single key is read.
+type apiKey struct {
+	Name     string
+	Login    string
+	URL      string   `json:",omitempty"`
+	Tags     []string `json:",omitempty"`
+	Modified time.Time
+	Password string  `json:",omitempty"`
+	Notes    string  `json:",omitempty"`
+	Fields   []field `json:",omitempty"`
+	OTP      string  `json:",omitempty"` // the current code
+}
+
+// accessRecord is a line of the access log.
+type accessRecord struct {
+	Time   time.Time
+	Client string
+	Op     string
+	Name   string `json:",omitempty"`
+	Result string
+}
+
+type apiServer struct {
+	mu        sync.Mutex // requests are served one at a time, prompts too
+	store     vault.Store
+	accessLog string
+	checkHost bool // reject Host headers other than localhost, against DNS rebinding
+}
+
+// accessLogPath is access.log next to the config file.
+func accessLogPath() (string, error) {
+	path, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "access.log"), nil
+}
+
+func serveAPI(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:7575", "localhost address to listen on")
+	socket := fs.String("socket", "", "listen on this unix socket instead of TCP")
+	fs.Parse(args)
+
+	accessLog, err := accessLogPath()
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	s := &apiServer{store: mustOpenStore(), accessLog: accessLog, checkHost: len(*socket) == 0}
+
+	var l net.Listener
+	if len(*socket) > 0 {
+		l, err = listenUnix(*socket)
+	} else {
+		host, _, serr := net.SplitHostPort(*addr)
+		if ip := net.ParseIP(host); serr != nil || host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			exitOnError(fmt.Sprintf("Invalid address %s, keybox serve only listens on localhost", *addr))
+		}
+		l, err = net.Listen("tcp", *addr)
+	}
+	if err != nil {
+		exitOnError(fmt.Sprintf("Cannot listen: %s", err))
+	}
+
+	loadDBFile()
+
+	srv := &http.Server{Handler: s.handler(), ReadHeaderTimeout: 5 * time.Second}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		srv.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "Serving %s on %s, approve the requests here\n", dbpath, l.Addr())
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		exitOnError(err.Error())
+	}
+	db.Close()
+}
+
+func (s *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/pair", s.pair)
+	mux.HandleFunc("/v1/keys", s.authorized(s.list))
+	mux.HandleFunc("/v1/keys/", s.authorized(s.get))
+	mux.HandleFunc("/v1/search", s.authorized(s.search))
+	mux.HandleFunc("/v1/generate", s.authorized(s.generate))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.checkHost && !localHost(r.Host) {
+			apiError(w, http.StatusForbidden, "Invalid host")
+			return
+		}
+		// web pages cannot send JSON without a preflight, which is never
+		// answered
+		if r.Method == http.MethodPost {
+			if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t != "application/json" {
+				apiError(w, http.StatusUnsupportedMediaType, "Expected application/json")
+				return
+			}
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func localHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+type apiHandler func(w http.ResponseWriter, r *http.Request, name string, c *config)
+
+// authorized passes the request on with the name of the client if its
+// token is valid. It reloads the vault first, it may have been changed by
+// another process.
+func (s *apiServer) authorized(h apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := loadConfig()
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		hash := tokenHash(token)
+		for name, client := range c.Clients {
+			if len(token) > 0 && hmac.Equal([]byte(client.TokenHash), []byte(hash)) {
+				s.reload()
+				h(w, r, name, c)
+				return
+			}
+		}
+		apiError(w, http.StatusUnauthorized, "Unknown client, pair it first")
+	}
+}
+
+// reload reopens the vault with the key it was unlocked with.
+func (s *apiServer) reload() {
+	if s.store == nil {
+		return
+	}
+	v, err := vault.OpenStore(s.store)
+	if err == nil {
+		err = v.UnlockKey(db.Key())
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot reload %s, serving the keys as loaded: %s\n", dbpath, err)
+		return
+	}
+	db = v
+}
+
+func (s *apiServer) pair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, http.StatusMethodNotAllowed, "Expected POST")
+		return
+	}
+	var req struct{ Client string }
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil || len(req.Client) == 0 {
+		apiError(w, http.StatusBadRequest, "Expected {\"Client\": name}")
+		return
+	}
+
+	// a paired client is only replaced once revoked, pairing again must not
+	// take over its token and allow-list
+	c, err := loadConfig()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if _, found := c.Clients[req.Client]; found {
+		s.record(req.Client, "pair", "", "exists")
+		apiError(w, http.StatusConflict, fmt.Sprintf("Client %s is paired already, revoke it first with keybox clients revoke %s", req.Client, req.Client))
+		return
+	}
+
+	if !confirm(fmt.Sprintf("Pair the client %s", req.Client)) {
+		s.record(req.Client, "pair", "", "denied")
+		apiError(w, http.StatusForbidden, "Pairing denied")
+		return
+	}
+
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(crand.Reader, b); err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	if c.Clients == nil {
+		c.Clients = make(map[string]*apiClient)
+	}
+	c.Clients[req.Client] = &apiClient{TokenHash: tokenHash(token), Paired: time.Now()}
+	if err := c.save(); err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.record(req.Client, "pair", "", "ok")
+	writeJSON(w, map[string]string{"Token": token})
+}
+
+func (s *apiServer) list(w http.ResponseWriter, r *http.Request, client string, c *config) {
+	if r.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "Expected GET")
+		return
+	}
+	list := []apiKey{}
+	for _, k := range db.List() {
+		list = append(list, keySummary(k))
+	}
+	s.record(client, "list", "", "ok")
+	writeJSON(w, list)
+}
+
+func (s *apiServer) search(w http.ResponseWriter, r *http.Request, client string, c *config) {
+	if r.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "Expected GET")
+		return
+	}
+	q := r.URL.Query()
+	list := []apiKey{}
+	for _, name := range searchKeys(q.Get("q"), keyFilter{Tag: q.Get("tag"), LoginContains: q.Get("login")}) {
+		k, _ := db.Get(name)
+		list = append(list, keySummary(k))
+	}
+	s.record(client, "search", q.Get("q"), "ok")
+	writeJSON(w, list)
+}
+
+func (s *apiServer) get(w http.ResponseWriter, r *http.Request, client string, c *config) {
+	if r.Method != http.MethodGet {
+		apiError(w, http.StatusMethodNotAllowed, "Expected GET")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/v1/keys/")
+	k, found := db.Get(name)
+	if !found {
+		s.record(client, "get", name, "not found")
+		apiError(w, http.StatusNotFound, fmt.Sprintf("Key %s not found", name))
+		return
+	}
+
+	if !s.approve(client, c, name) {
+		s.record(client, "get", name, "denied")
+		apiError(w, http.StatusForbidden, "Access denied")
+		return
+	}
+
+	ak := keySummary(k)
+	ak.Password, ak.Notes, ak.Fields = k.Password, k.Notes, k.Fields
+	// reading a HOTP code would use it up
+	if k.OTP != nil && k.OTP.Type == "totp" {
+		if code, _, err := k.OTP.Code(time.Now()); err == nil {
+			ak.OTP = code
+		}
+	}
+	s.record(client, "get", name, "ok")
+	writeJSON(w, ak)
+}
+
+func (s *apiServer) generate(w http.ResponseWriter, r *http.Request, client string, c *config) {
+	if r.Method != http.MethodPost {
+		apiError(w, http.StatusMethodNotAllowed, "Expected POST")
+		return
+	}
+	req := struct{ Preset string }{"default"}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil && err != io.EOF {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p, found := passwordPresets[req.Preset]
+	if !found {
+		apiError(w, http.StatusBadRequest, fmt.Sprintf("Unknown preset %s, expected one of %s", req.Preset, strings.Join(presetNames(), ", ")))
+		return
+	}
+	pw, err := generatePassword(p)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.record(client, "generate", req.Preset, "ok")
+	writeJSON(w, map[string]string{"Password": pw})
+}
+
+// approve tells whether client may read the key name: either it is on the
+// allow-list of the client, or the read is approved on the terminal.
+// Answering always adds the key to the allow-list.
+func (s *apiServer) approve(client string, c *config, name string) bool {
+	for _, p := range c.Clients[client].Allow {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+
+	switch strings.ToLower(getPromptedInput(fmt.Sprintf("Allow %s to read %s? [y/N/always]", client, name))) {
+	case "y", "yes":
+		return true
+	case "a", "always":
+		c.Clients[client].Allow = append(c.Clients[client].Allow, name)
+		if err := c.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot save config: %s\n", err)
+		}
+		return true
+	}
+	return false
+}
+
+// record appends a line to the access log. A failure is reported but does
+// not fail the request.
+func (s *apiServer) record(client, op, name, result string) {
+	line, _ := json.Marshal(accessRecord{time.Now(), client, op, name, result})
+	f, err := os.OpenFile(s.accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		f.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write the access log: %s\n", err)
+	}
+}
+
+func keySummary(k key) apiKey {
+	return apiKey{Name: k.Name, Login: k.Login, URL: k.URL, Tags: k.Tags, Modified: k.Modified}
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"Error": msg})
+}
+
+// manageClients lists the paired clients, changes their allow-lists,
+// revokes them and shows the access log.
+func manageClients(args []string) {
+	usage := "Usage: keybox clients {list | allow <client> <pattern> | deny <client> <pattern> | revoke <client> | log [-n N]}"
+	if len(args) == 0 {
+		exitOnError(usage)
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	if args[0] == "log" {
+		showAccessLog(args[1:])
+		return
+	}
+	if args[0] == "list" && len(args) == 1 {
+		for _, name := range c.clientNames() {
+			cl := c.Clients[name]
+			fmt.Printf("%-15s paired %s  allowed %s\n", name, cl.Paired.Format("2006-01-02"), strings.Join(cl.Allow, ", "))
+		}
+		return
+	}
+	if len(args) < 2 {
+		exitOnError(usage)
+	}
+
+	cl, found := c.Clients[args[1]]
+	if !found {
+		exitOnError(fmt.Sprintf("Unknown client %s", args[1]))
+	}
+	switch {
+	case args[0] == "allow" && len(args) == 3:
+		if _, err := path.Match(args[2], ""); err != nil {
+			exitOnError(fmt.Sprintf("Invalid pattern %s", args[2]))
+		}
+		cl.Allow = append(cl.Allow, args[2])
+	case args[0] == "deny" && len(args) == 3:
+		var allow []string
+		for _, p := range cl.Allow {
+			if p != args[2] {
+				allow = append(allow, p)
+			}
+		}
+		cl.Allow = allow
+	case args[0] == "revoke" && len(args) == 2:
+		delete(c.Clients, args[1])
+	default:
+		exitOnError(usage)
+	}
+
+	if err := c.save(); err != nil {
+		exitOnError(fmt.Sprintf("Cannot save config: %s", err))
+	}
+}
+
+func showAccessLog(args []string) {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	n := fs.Int("n", 0, "show the last n records only")
+	fs.Parse(args)
+
+	path, err := accessLogPath()
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	defer f.Close()
+
+	var records []accessRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r accessRecord
+		if json.Unmarshal(scanner.Bytes(), &r) == nil {
+			records = append(records, r)
+		}
+	}
+	if *n > 0 && *n < len(records) {
+		records = records[len(records)-*n:]
+	}
+	for _, r := range records {
+		fmt.Printf("%-25s %-15s %-9s %-10s %s\n", r.Time.Format(time.RFC3339), r.Client, r.Op, r.Result, r.Name)
+	}
+}
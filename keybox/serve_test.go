@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	os.Setenv("KEYBOX_CONFIG", filepath.Join(dir, "config.json"))
+	defer os.Unsetenv("KEYBOX_CONFIG")
+	defer func(r *bufio.Reader) { stdin = r }(stdin)
+	// pair, get github, deny bank, always gitlab
+	stdin = bufio.NewReader(strings.NewReader("y\ny\nn\nalways\n"))
+
+	useKeys(t,
+		key{Name: "github", Login: "me", Password: "gh-secret", Tags: []string{"code"}},
+		key{Name: "gitlab", Login: "me", Password: "gl-secret", Tags: []string{"code"}},
+		key{Name: "bank", Login: "me", Password: "bank-secret"},
+	)
+	s := &apiServer{accessLog: filepath.Join(dir, "access.log"), checkHost: true}
+	h := s.handler()
+
+	do := func(method, target, token, body string) (int, string) {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Host = "127.0.0.1:7575"
+		if strings.HasPrefix(body, "{") {
+			r.Header.Set("Content-Type", "application/json")
+		}
+		if len(token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	code, body := do("POST", "/v1/pair", "", `{"Client": "firefox"}`)
+	var paired struct{ Token string }
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &paired) != nil || len(paired.Token) == 0 {
+		t.Fatalf("pair: %d %s", code, body)
+	}
+	token := paired.Token
+
+	if code, body = do("GET", "/v1/keys", token, ""); code != http.StatusOK || strings.Contains(body, "secret") || !strings.Contains(body, "bank") {
+		t.Errorf("list: %d %s", code, body)
+	}
+	if code, body = do("GET", "/v1/search?tag=code", token, ""); code != http.StatusOK || strings.Contains(body, "bank") || !strings.Contains(body, "gitlab") {
+		t.Errorf("search: %d %s", code, body)
+	}
+
+	if code, body = do("GET", "/v1/keys/github", token, ""); code != http.StatusOK || !strings.Contains(body, "gh-secret") {
+		t.Errorf("approved get: %d %s", code, body)
+	}
+	if code, body = do("GET", "/v1/keys/bank", token, ""); code != http.StatusForbidden || strings.Contains(body, "bank-secret") {
+		t.Errorf("denied get: %d %s", code, body)
+	}
+	// the second read is not prompted, nothing is left to answer
+	for i := 0; i < 2; i++ {
+		if code, body = do("GET", "/v1/keys/gitlab", token, ""); code != http.StatusOK || !strings.Contains(body, "gl-secret") {
+			t.Errorf("allowed get %d: %d %s", i, code, body)
+		}
+	}
+	if code, _ = do("GET", "/v1/keys/missing", token, ""); code != http.StatusNotFound {
+		t.Errorf("missing key: got %d", code)
+	}
+
+	if code, body = do("POST", "/v1/generate", token, `{"Preset": "pin"}`); code != http.StatusOK || !strings.Contains(body, "Password") {
+		t.Errorf("generate: %d %s", code, body)
+	}
+
+	if code, _ = do("GET", "/v1/keys/github", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("no token: got %d", code)
+	}
+	if code, _ = do("GET", "/v1/keys/github", "wrong", ""); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: got %d", code)
+	}
+	if code, _ = do("POST", "/v1/pair", "", "Client=evil"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("form post: got %d", code)
+	}
+	// the pairing is not even asked for
+	if code, _ = do("POST", "/v1/pair", "", `{"Client": "firefox"}`); code != http.StatusConflict {
+		t.Errorf("pair an existing client: got %d", code)
+	}
+
+	r := httptest.NewRequest("GET", "/v1/keys", nil)
+	r.Host = "attacker.example:7575"
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("rebound host: got %d", w.Code)
+	}
+
+	content, err := ioutil.ReadFile(s.accessLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := string(content)
+	if n := strings.Count(log, "\n"); n != 10 {
+		t.Errorf("got %d access records, want 10:\n%s", n, log)
+	}
+	if !strings.Contains(log, `"Client":"firefox","Op":"get","Name":"bank","Result":"denied"`) {
+		t.Errorf("denied read not recorded:\n%s", log)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The agents listen on unix sockets only the user can connect to. A socket
+// is created 0600 from the start, in XDG_RUNTIME_DIR or in a directory of
+// the temp directory that is the user's own and 0700, and both ends check
+// that the other one runs as the same user.
+
+// socketDir returns XDG_RUNTIME_DIR or keybox-<uid> in the temp directory,
+// created if needed.
+func socketDir() (string, error) {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); len(dir) > 0 {
+		return dir, nil
+	}
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("keybox-%d", os.Getuid()))
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	if err := checkOwner(dir, true); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// listenUnix listens on a socket at path, replacing a stale one. Connections
+// of other users are dropped.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path) // stale socket
+	}
+	l, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	return peerListener{l}, nil
+}
+
+type peerListener struct {
+	net.Listener
+}
+
+func (l peerListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPeer(conn); err != nil {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+// dialUnix connects to the socket at path if it is the user's own and the
+// process listening on it runs as the user.
+func dialUnix(path string, timeout time.Duration) (net.Conn, error) {
+	if err := checkOwner(path, false); err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPeer(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func checkPeer(conn net.Conn) error {
+	uid, err := peerUID(conn)
+	if err != nil {
+		return err
+	}
+	if uid != os.Getuid() {
+		return fmt.Errorf("Peer of %s runs as user %d", conn.LocalAddr(), uid)
+	}
+	return nil
+}
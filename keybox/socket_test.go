@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix permissions")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent.sock")
+
+	l, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v, want 0600", fi.Mode().Perm())
+	}
+
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := dialUnix(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, nil, 0600)
+	if _, err := dialUnix(file, time.Second); err == nil {
+		t.Error("dialed a regular file")
+	}
+
+	os.Setenv("TMPDIR", dir)
+	defer os.Unsetenv("TMPDIR")
+	defer func(v string) { os.Setenv("XDG_RUNTIME_DIR", v) }(os.Getenv("XDG_RUNTIME_DIR"))
+	os.Unsetenv("XDG_RUNTIME_DIR")
+	sdir, err := socketDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(sdir); fi.Mode().Perm() != 0700 {
+		t.Errorf("socket directory mode %v, want 0700", fi.Mode().Perm())
+	}
+	os.Chmod(sdir, 0755)
+	if _, err := socketDir(); err == nil {
+		t.Error("used a socket directory others can read")
+	}
+}
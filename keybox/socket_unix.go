@@ -0,0 +1,42 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+var umaskMu sync.Mutex
+
+// listenPrivate creates the socket with a umask that leaves it 0600, the
+// umask being per process.
+func listenPrivate(path string) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
+
+// checkOwner checks that path is owned by the user and is a directory only
+// the user can use, or a socket.
+func checkOwner(path string, dir bool) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s is not owned by you", path)
+	}
+	if dir && (!fi.IsDir() || fi.Mode().Perm()&0077 != 0) {
+		return fmt.Errorf("%s is not a directory only you can use", path)
+	}
+	if !dir && fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s is not a socket", path)
+	}
+	return nil
+}
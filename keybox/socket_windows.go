@@ -0,0 +1,23 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// On Windows the socket gets the ACL of its directory and there are no
+// peer credentials, the user profile is private already.
+
+func listenPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
+
+func checkOwner(path string, dir bool) error {
+	return nil
+}
+
+func peerUID(conn net.Conn) (int, error) {
+	return os.Getuid(), nil
+}
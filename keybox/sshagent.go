@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Keys can hold an SSH private key, which keybox ssh-agent serves with the
+// ssh-agent protocol once the vault is unlocked. A key added with -confirm
+// is only used after the signature is approved on the terminal of the
+// agent, one added with -lifetime is dropped by the agent after that time.
+
+// sshKeyCmd prints the public key of a key in the authorized_keys format.
+// Setting the private key is done with -file or -generate.
+func sshKeyCmd(args []string) {
+	fs := flag.NewFlagSet("ssh", flag.ExitOnError)
+	file := fs.String("file", "", "set the private key from this file, - for stdin")
+	generate := fs.String("generate", "", "set a new private key of this type: ed25519, ecdsa or rsa")
+	comment := fs.String("comment", "", "comment of the public key, the key name by default")
+	confirmUse := fs.Bool("confirm", false, "have the agent ask before every use of the key")
+	lifetime := fs.Duration("lifetime", 0, "have the agent drop the key after this time, e.g. 8h")
+	remove := fs.Bool("remove", false, "remove the SSH key from the key")
+	names := parseInterspersed(fs, args)
+	if len(names) != 1 {
+		exitOnError("Usage: keybox ssh <name> [-file path | -generate ed25519] [-comment text] [-confirm] [-lifetime 8h] [-remove]")
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	lockDBFile()
+	loadDBFile()
+
+	k, found := db.Get(names[0])
+	newKey := len(*file) > 0 || len(*generate) > 0
+	if !found && !newKey {
+		exitOnError(fmt.Sprintf("Key %s not found", names[0]))
+	}
+	if !found {
+		k = key{Name: names[0]}
+	}
+
+	if len(set) > 0 {
+		if *remove {
+			k.SSH = nil
+		} else {
+			if newKey {
+				s, err := readSSHKey(*file, *generate)
+				if err != nil {
+					exitOnError(err.Error())
+				}
+				if k.SSH != nil {
+					s.Comment, s.Confirm, s.Lifetime = k.SSH.Comment, k.SSH.Confirm, k.SSH.Lifetime
+				}
+				k.SSH = s
+			}
+			if k.SSH == nil {
+				exitOnError(fmt.Sprintf("Key %s has no SSH key, set one with -file or -generate", k.Name))
+			}
+			if set["comment"] {
+				k.SSH.Comment = *comment
+			}
+			if set["confirm"] {
+				k.SSH.Confirm = *confirmUse
+			}
+			if set["lifetime"] {
+				k.SSH.Lifetime = int(lifetime.Seconds())
+			}
+			if len(k.SSH.Comment) == 0 {
+				k.SSH.Comment = k.Name
+			}
+		}
+		db.Put(k)
+
+		saveDBFile()
+		if k.SSH == nil {
+			return
+		}
+	}
+
+	if k.SSH == nil {
+		exitOnError(fmt.Sprintf("Key %s has no SSH key", k.Name))
+	}
+	line, err := k.SSH.AuthorizedKey()
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	fmt.Println(line)
+}
+
+// readSSHKey reads the private key in file, asking for its passphrase if it
+// is encrypted, or generates one of type generate.
+func readSSHKey(file, generate string) (*vault.SSHKey, error) {
+	if len(generate) > 0 {
+		return vault.GenerateSSHKey(generate)
+	}
+
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = ioutil.ReadAll(stdin)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := vault.ParseSSHKey(data, nil)
+	if err == vault.ErrSSHPassphrase {
+		s, err = vault.ParseSSHKey(data, []byte(getSecretInput("Passphrase of the SSH key")))
+	}
+	return s, err
+}
+
+func runSSHAgent(args []string) {
+	fs := flag.NewFlagSet("ssh-agent", flag.ExitOnError)
+	path := fs.String("socket", "", "unix socket to listen on, keybox-ssh.sock in the socket directory by default")
+	fs.Parse(args)
+
+	if len(*path) == 0 {
+		dir, err := socketDir()
+		if err != nil {
+			exitOnError(fmt.Sprintf("Cannot create the agent socket: %s", err))
+		}
+		*path = filepath.Join(dir, "keybox-ssh.sock")
+	}
+
+	loadDBFile()
+	a := newSSHAgent(confirm)
+	n, err := a.load(db.List())
+	db.Close()
+	if err != nil {
+		exitOnError(err.Error())
+	}
+
+	l, err := listenUnix(*path)
+	if err != nil {
+		exitOnError(fmt.Sprintf("Cannot listen on %s: %s", *path, err))
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		a.RemoveAll()
+		l.Close()
+	}()
+
+	fmt.Fprintf(os.Stderr, "Loaded %d SSH keys from %s\n", n, dbpath)
+	fmt.Printf("SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n", *path)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			agent.ServeAgent(a, conn)
+		}()
+	}
+}
+
+// sshAgent is the keyring of the agent package, which does not support the
+// confirm constraint, with that constraint kept here: the keys added with it
+// sign only once ask approves.
+type sshAgent struct {
+	agent.ExtendedAgent
+	mu      sync.Mutex // one prompt at a time
+	confirm map[string]string
+	ask     func(prompt string) bool
+}
+
+func newSSHAgent(ask func(prompt string) bool) *sshAgent {
+	return &sshAgent{
+		ExtendedAgent: agent.NewKeyring().(agent.ExtendedAgent),
+		confirm:       make(map[string]string),
+		ask:           ask,
+	}
+}
+
+// load adds the SSH keys of ks and returns how many there were.
+func (a *sshAgent) load(ks []key) (int, error) {
+	n := 0
+	for _, k := range ks {
+		if k.SSH == nil {
+			continue
+		}
+		raw, err := k.SSH.RawKey()
+		if err != nil {
+			return n, fmt.Errorf("Key %s: %s", k.Name, err)
+		}
+		comment := k.SSH.Comment
+		if len(comment) == 0 {
+			comment = k.Name
+		}
+		err = a.Add(agent.AddedKey{
+			PrivateKey:       raw,
+			Comment:          comment,
+			LifetimeSecs:     uint32(k.SSH.Lifetime),
+			ConfirmBeforeUse: k.SSH.Confirm,
+		})
+		if err != nil {
+			return n, fmt.Errorf("Key %s: %s", k.Name, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (a *sshAgent) Add(key agent.AddedKey) error {
+	signer, err := ssh.NewSignerFromKey(key.PrivateKey)
+	if err != nil {
+		return err
+	}
+	confirmUse := key.ConfirmBeforeUse
+	key.ConfirmBeforeUse = false
+	if err := a.ExtendedAgent.Add(key); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	blob := string(signer.PublicKey().Marshal())
+	if confirmUse {
+		a.confirm[blob] = key.Comment
+	} else {
+		delete(a.confirm, blob)
+	}
+	return nil
+}
+
+func (a *sshAgent) Remove(key ssh.PublicKey) error {
+	a.mu.Lock()
+	delete(a.confirm, string(key.Marshal()))
+	a.mu.Unlock()
+	return a.ExtendedAgent.Remove(key)
+}
+
+func (a *sshAgent) RemoveAll() error {
+	a.mu.Lock()
+	a.confirm = make(map[string]string)
+	a.mu.Unlock()
+	return a.ExtendedAgent.RemoveAll()
+}
+
+func (a *sshAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a *sshAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	a.mu.Lock()
+	comment, found := a.confirm[string(key.Marshal())]
+	allowed := !found || a.ask(fmt.Sprintf("Allow signing with %s (%s)", comment, ssh.FingerprintSHA256(key)))
+	a.mu.Unlock()
+
+	if !allowed {
+		return nil, errors.New("signature refused")
+	}
+	return a.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+// sshLifetime formats the lifetime constraint of an SSH key.
+func sshLifetime(s *vault.SSHKey) string {
+	if s.Lifetime == 0 {
+		return "unlimited"
+	}
+	return (time.Duration(s.Lifetime) * time.Second).String()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestSSHAgent(t *testing.T) {
+	free, err := vault.GenerateSSHKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guarded, err := vault.GenerateSSHKey("ecdsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guarded.Confirm, guarded.Lifetime = true, 3600
+
+	var answers []bool
+	var prompts int
+	a := newSSHAgent(func(string) bool {
+		prompts++
+		answer := answers[0]
+		answers = answers[1:]
+		return answer
+	})
+	n, err := a.load([]key{{Name: "web", SSH: free}, {Name: "prod", SSH: guarded}, {Name: "plain", Password: "x"}})
+	if err != nil || n != 2 {
+		t.Fatalf("load: %d, %v", n, err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go agent.ServeAgent(a, server)
+	c := agent.NewClient(client)
+
+	keys, err := c.List()
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("list: %v, %v", keys, err)
+	}
+	byComment := make(map[string]ssh.PublicKey)
+	for _, k := range keys {
+		byComment[k.Comment] = k
+	}
+
+	data := []byte("session")
+	sig, err := c.Sign(byComment["web"], data)
+	if err != nil || byComment["web"].Verify(data, sig) != nil || prompts != 0 {
+		t.Errorf("sign with web: %v, %d prompts", err, prompts)
+	}
+
+	answers = []bool{false, true}
+	if _, err := c.Sign(byComment["prod"], data); err == nil {
+		t.Error("refused signature made")
+	}
+	sig, err = c.Sign(byComment["prod"], data)
+	if err != nil || byComment["prod"].Verify(data, sig) != nil || prompts != 2 {
+		t.Errorf("approved sign with prod: %v, %d prompts", err, prompts)
+	}
+
+	if err := c.RemoveAll(); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := c.List(); len(keys) != 0 {
+		t.Errorf("%d keys left after remove all", len(keys))
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// The location of a vault, in KEYBOXFILE, -vault or the config, is the path
+// of a vault file or one of
+//
+//	dir:PATH            a directory with one encrypted file per key
+//	sqlite:PATH         an SQLite database
+//	s3://BUCKET/PREFIX  an S3-compatible object store
+//
+// The S3 endpoint is AWS_ENDPOINT_URL, s3.amazonaws.com by default, and the
+// credentials are AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+
+// openStore returns the store of the vault at location.
+func openStore(location string) (vault.Store, error) {
+	switch {
+	case strings.HasPrefix(location, "dir:"):
+		return vault.NewDirStore(strings.TrimPrefix(location, "dir:")), nil
+	case strings.HasPrefix(location, "sqlite:"):
+		return vault.OpenSQLiteStore(strings.TrimPrefix(location, "sqlite:"))
+	case strings.HasPrefix(location, "s3://"):
+		return openS3Store(location)
+	}
+
+	s := vault.NewFileStore(location)
+	s.Backups = backupCount()
+	return s, nil
+}
+
+func openS3Store(location string) (vault.Store, error) {
+	u, err := url.Parse(location)
+	if err != nil || len(u.Host) == 0 {
+		return nil, fmt.Errorf("Invalid S3 location %s, expected s3://bucket/prefix", location)
+	}
+
+	endpoint, secure := "s3.amazonaws.com", true
+	if e := os.Getenv("AWS_ENDPOINT_URL"); len(e) > 0 {
+		eu, err := url.Parse(e)
+		if err != nil || len(eu.Host) == 0 {
+			return nil, fmt.Errorf("Invalid AWS_ENDPOINT_URL %s", e)
+		}
+		endpoint, secure = eu.Host, eu.Scheme != "http"
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewEnvAWS(),
+		Secure: secure,
+		Region: os.Getenv("AWS_REGION"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vault.NewS3Store(client, u.Host, strings.Trim(u.Path, "/")), nil
+}
+
+// openStores are the stores returned by mustOpenStore that hold a
+// connection, closed by closeStores once the command is done.
+var openStores []io.Closer
+
+// mustOpenStore returns the store of the selected vault.
+func mustOpenStore() vault.Store {
+	s, err := openStore(dbpath)
+	if err != nil {
+		exitOnError(fmt.Sprintf("Cannot open %s: %s", dbpath, err))
+	}
+	if c, ok := s.(io.Closer); ok {
+		openStores = append(openStores, c)
+	}
+	return s
+}
+
+func closeStores() {
+	for _, c := range openStores {
+		c.Close()
+	}
+	openStores = nil
+}
+
+// localPath returns the local file or directory of the vault at location,
+// "" if it is remote.
+func localPath(location string) string {
+	switch {
+	case strings.HasPrefix(location, "dir:"):
+		return strings.TrimPrefix(location, "dir:")
+	case strings.HasPrefix(location, "sqlite:"):
+		return strings.TrimPrefix(location, "sqlite:")
+	case strings.HasPrefix(location, "s3://"):
+		return ""
+	}
+	return location
+}
+
+// isVaultFile reports whether the vault at location is a single file.
+func isVaultFile(location string) bool {
+	return localPath(location) == location
+}
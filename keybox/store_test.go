@@ -0,0 +1,25 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+)
+
+func TestCloseStores(t *testing.T) {
+	defer func(path string) { dbpath = path }(dbpath)
+	dbpath = "sqlite:" + filepath.Join(t.TempDir(), "vault.db")
+
+	s := mustOpenStore()
+	if _, _, err := s.Get("vault"); err != vault.ErrNotFound {
+		t.Fatalf("open store: %v", err)
+	}
+	closeStores()
+	if _, _, err := s.Get("vault"); err == nil || err == vault.ErrNotFound {
+		t.Errorf("store still open: %v", err)
+	}
+	if len(openStores) != 0 {
+		t.Errorf("%d stores left", len(openStores))
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// commonPasswords are the most used passwords, most common first. The rank
+// is the number of guesses.
+var commonPasswords = strings.Fields(`
+	123456 password 123456789 12345678 12345 qwerty 1234567 111111 1234567890
+	123123 abc123 1234 password1 iloveyou 1q2w3e4r 000000 qwerty123 zaq12wsx
+	dragon sunshine princess letmein 654321 monkey 1qaz2wsx 123321
+	qwertyuiop superman asdfghjkl trustno1 football baseball welcome shadow
+	master michael jennifer hunter ashley jessica charlie daniel mustang
+	access batman passw0rd starwars login admin solo secret freedom whatever
+	qazwsx ninja azerty loveme hello flower hottie lovely 666666 121212
+	donald bailey computer thomas killer soccer hockey jordan harley ranger
+	robert buster tigger summer winter spring autumn cheese pepper ginger
+	matrix maggie cookie orange purple silver golden diamond banana chocolate
+	internet samsung google facebook changeme default test guest root
+	administrator qwe123 asdf1234 pass pass123 password123 letmein1 abcdef
+`)
+
+var commonRank = make(map[string]int)
+var dictionary = make(map[string]bool)
+
+var leetChars = map[rune]rune{'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i', '!': 'i', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't', '2': 'z'}
+
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm", "azertyuiop", "qwertzuiop"}
+
+const (
+	minMatchLength   = 3
+	maxWordLength    = 20
+	maxPatternLength = 64
+
+	// guesses per character not covered by a pattern, as in zxcvbn
+	bruteforceCardinality = 10
+)
+
+func loadDictionary() {
+	if len(commonRank) > 0 {
+		return
+	}
+	for i, p := range commonPasswords {
+		if _, found := commonRank[p]; !found {
+			commonRank[p] = i + 1
+		}
+	}
+	for _, w := range loadWordlist() {
+		dictionary[w] = true
+	}
+}
+
+// estimateGuesses estimates how many guesses an attacker needs to find pw,
+// in the spirit of zxcvbn: pw is split into the cheapest sequence of
+// patterns (common passwords, words, their l33t and capitalized variants,
+// sequences, repeats, keyboard rows and years) with brute force for the
+// rest, and the guesses of the parts are multiplied.
+func estimateGuesses(pw string) float64 {
+	loadDictionary()
+
+	r := []rune(pw)
+	if len(r) == 0 {
+		return 1
+	}
+
+	// best[j] is the fewest guesses for r[:j]
+	best := make([]float64, len(r)+1)
+	best[0] = 1
+	for j := 1; j <= len(r); j++ {
+		best[j] = best[j-1] * bruteforceCardinality
+		for i := max(0, j-maxPatternLength); i < j; i++ {
+			if g := patternGuesses(r[i:j]); g > 0 && best[i]*g < best[j] {
+				best[j] = best[i] * g
+			}
+		}
+	}
+	return best[len(r)]
+}
+
+// patternGuesses returns the guesses for s as a single pattern, 0 if it is
+// none.
+func patternGuesses(s []rune) float64 {
+	if len(s) < minMatchLength {
+		return 0
+	}
+
+	best := math.Inf(1)
+	if g := wordGuesses(s); g > 0 {
+		best = g
+	}
+	for _, g := range []float64{repeatGuesses(s), sequenceGuesses(s), keyboardGuesses(s), yearGuesses(s)} {
+		if g > 0 && g < best {
+			best = g
+		}
+	}
+	if math.IsInf(best, 1) {
+		return 0
+	}
+	return best
+}
+
+func wordGuesses(s []rune) float64 {
+	if len(s) > maxWordLength {
+		return 0
+	}
+
+	lower := []rune(strings.ToLower(string(s)))
+	variations := float64(caseVariations(s))
+
+	rank := func(w string) float64 {
+		if r, found := commonRank[w]; found {
+			return float64(r)
+		}
+		if dictionary[w] {
+			return float64(len(wordlist))
+		}
+		return 0
+	}
+
+	if g := rank(string(lower)); g > 0 {
+		return g * variations
+	}
+
+	subs := 0
+	unleet := make([]rune, len(lower))
+	for i, c := range lower {
+		if l, found := leetChars[c]; found {
+			unleet[i] = l
+			subs++
+		} else {
+			unleet[i] = c
+		}
+	}
+	if subs > 0 {
+		if g := rank(string(unleet)); g > 0 {
+			return g * variations * math.Pow(2, float64(subs))
+		}
+	}
+	return 0
+}
+
+// caseVariations is the number of ways a word could have been capitalized
+// to give s: all lowercase is free, a capital first or all caps is common,
+// anything else is counted by its uppercase letters.
+func caseVariations(s []rune) int {
+	upper, lower := 0, 0
+	for _, c := range s {
+		if unicode.IsUpper(c) {
+			upper++
+		} else if unicode.IsLower(c) {
+			lower++
+		}
+	}
+	switch {
+	case upper == 0:
+		return 1
+	case lower == 0 || upper == 1 && unicode.IsUpper(s[0]):
+		return 2
+	}
+	n := upper
+	if lower < n {
+		n = lower
+	}
+	return 1 << uint(n)
+}
+
+func repeatGuesses(s []rune) float64 {
+	for _, c := range s[1:] {
+		if c != s[0] {
+			return 0
+		}
+	}
+	return bruteforceCardinality * float64(len(s))
+}
+
+// sequenceGuesses matches runs like abc, 9876 or aceg.
+func sequenceGuesses(s []rune) float64 {
+	delta := s[1] - s[0]
+	if delta == 0 || delta > 5 || delta < -5 {
+		return 0
+	}
+	for i := 2; i < len(s); i++ {
+		if s[i]-s[i-1] != delta {
+			return 0
+		}
+	}
+
+	base := 26.0
+	switch {
+	case s[0] == 'a' || s[0] == 'A' || s[0] == '0' || s[0] == '1':
+		base = 4
+	case unicode.IsDigit(s[0]):
+		base = 10
+	}
+	if delta < 0 || delta > 1 {
+		base *= 2
+	}
+	return base * float64(len(s))
+}
+
+func keyboardGuesses(s []rune) float64 {
+	if len(s) < 4 {
+		return 0
+	}
+	lower := strings.ToLower(string(s))
+	reversed := []rune(lower)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	for _, row := range keyboardRows {
+		if strings.Contains(row, lower) || strings.Contains(row, string(reversed)) {
+			return 40 * float64(len(s))
+		}
+	}
+	return 0
+}
+
+func yearGuesses(s []rune) float64 {
+	if len(s) != 4 || (string(s[:2]) != "19" && string(s[:2]) != "20") {
+		return 0
+	}
+	for _, c := range s[2:] {
+		if !unicode.IsDigit(c) {
+			return 0
+		}
+	}
+	return 120
+}
+
+// strengthScore maps guesses to the 0 to 4 score of zxcvbn.
+func strengthScore(guesses float64) int {
+	for score, limit := range []float64{1e3, 1e6, 1e8, 1e10} {
+		if guesses < limit+5 {
+			return score
+		}
+	}
+	return 4
+}
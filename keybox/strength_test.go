@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestStrengthScore(t *testing.T) {
+	for _, tc := range []struct {
+		password string
+		min, max int
+	}{
+		{"password", 0, 0},
+		{"P@ssw0rd", 0, 0},
+		{"Password1", 0, 1},
+		{"qwertyuiop", 0, 0},
+		{"abcdefgh", 0, 0},
+		{"aaaaaaaaaaaa", 0, 0},
+		{"1987", 0, 0},
+		{"monkey1987", 0, 1},
+		{"Xk9#mP2q", 2, 3},
+		{"correct-horse-battery-staple", 4, 4},
+		{"t7$Kq!vZ2@pL9#wR", 4, 4},
+	} {
+		if s := strengthScore(estimateGuesses(tc.password)); s < tc.min || s > tc.max {
+			t.Errorf("%s: score %d (%g guesses), want %d to %d", tc.password, s, estimateGuesses(tc.password), tc.min, tc.max)
+		}
+	}
+}
+
+func TestCaseVariations(t *testing.T) {
+	for s, want := range map[string]int{"word": 1, "Word": 2, "WORD": 2, "wOrD": 4, "wORd": 4} {
+		if got := caseVariations([]rune(s)); got != want {
+			t.Errorf("caseVariations(%s) = %d, want %d", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/goofy-coder/Go/keybox/vault"
+)
+
+// keybox sync keeps a vault in a git repository in step with its upstream.
+// git cannot merge the encrypted file, so when both sides have commits the
+// three versions are decrypted and merged key by key with vault.Merge.
+// Commit messages and the output only ever name the vault file and the
+// keys, never their contents. The attachments, in the directory next to the
+// vault, are committed with it; the backups and the lock stay out of git.
+
+func syncVault(args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	noPush := fs.Bool("no-push", false, "merge the upstream changes but do not push")
+	fs.Parse(args)
+
+	if !isVaultFile(dbpath) {
+		exitOnError("Only vault files can be synced with git")
+	}
+	lockDBFile()
+	loadDBFile()
+
+	name := "./" + filepath.Base(dbpath)
+	if _, err := git("rev-parse", "--show-toplevel"); err != nil {
+		exitOnError(fmt.Sprintf("%s is not in a git repository", dbpath))
+	}
+	if _, err := git("rev-parse", "--abbrev-ref", "@{u}"); err != nil {
+		exitOnError("The branch has no upstream, set one with git branch -u")
+	}
+
+	excludeBackups(filepath.Base(dbpath))
+	if paths := syncPaths(name); len(mustGit(append([]string{"status", "--porcelain", "--"}, paths...)...)) > 0 {
+		mustGit(append([]string{"add", "-A", "--"}, paths...)...)
+		mustGit(append([]string{"commit", "-q", "-m", "keybox: update vault", "--"}, paths...)...)
+	}
+
+	mustGit("fetch", "-q")
+	var ahead, behind int
+	fmt.Sscan(mustGit("rev-list", "--left-right", "--count", "HEAD...@{u}"), &ahead, &behind)
+
+	switch {
+	case ahead == 0 && behind == 0:
+		fmt.Println("Already up to date")
+		return
+	case ahead == 0:
+		mustGit("merge", "-q", "--ff-only", "@{u}")
+		fmt.Println("Fast-forwarded to upstream")
+		return
+	case behind > 0:
+		mergeUpstream(name)
+	}
+
+	if *noPush {
+		return
+	}
+	mustGit("push", "-q")
+	fmt.Println("Pushed")
+}
+
+// mergeUpstream merges the upstream branch into the loaded vault and
+// commits the result as a merge.
+func mergeUpstream(name string) {
+	// the vault is never merged by git as it is binary, a merge stopped by
+	// conflicts is left in progress and resolved below
+	if _, err := git("merge", "-q", "--no-ff", "--no-commit", "@{u}"); err != nil {
+		if _, merging := git("rev-parse", "-q", "--verify", "MERGE_HEAD"); merging != nil {
+			exitOnError(err.Error())
+		}
+	}
+	onExit = func() { git("merge", "--abort") }
+	var others []string
+	for _, f := range strings.Fields(mustGit("diff", "--name-only", "--relative", "--diff-filter=U")) {
+		if f != filepath.Base(dbpath) {
+			others = append(others, f)
+		}
+	}
+	if len(others) > 0 {
+		exitOnError(fmt.Sprintf("Conflicts in %s, merge them with git first", strings.Join(others, ", ")))
+	}
+	// git may have replaced the file with theirs, keybox merges it from ours
+	mustGit("checkout", "-q", "HEAD", "--", name)
+
+	var base *vault.Vault
+	if content := gitShow(mustGit("merge-base", "HEAD", "@{u}"), name); content != nil {
+		var err error
+		if base, err = openVersion(content, "common"); err != nil {
+			exitOnError(fmt.Sprintf("Cannot open the common version: %s", err))
+		}
+	}
+	content := gitShow("@{u}", name)
+	if content == nil {
+		exitOnError("The vault was removed upstream")
+	}
+	theirs, err := openVersion(content, "upstream")
+	if err != nil {
+		exitOnError(fmt.Sprintf("Cannot open the upstream version: %s", err))
+	}
+
+	conflicts, err := db.Merge(base, theirs)
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	db.LogOp("sync", "")
+	saveDBFile()
+	agentPutKey(db.Key())
+
+	mustGit(append([]string{"add", "-A", "--"}, syncPaths(name)...)...)
+	mustGit("commit", "-q", "--no-edit", "-m", "keybox: merge vault")
+	onExit = nil
+
+	for _, c := range conflicts {
+		fmt.Printf("Changed on both sides: %s, kept the newer version\n", c)
+	}
+	fmt.Println("Merged upstream")
+}
+
+// syncPaths returns the vault file name and, if it has any, the directory of
+// its attachments.
+func syncPaths(name string) []string {
+	paths := []string{name}
+	if _, err := os.Stat(dbpath + ".d"); err == nil {
+		paths = append(paths, name+".d")
+	} else if tracked, _ := git("ls-files", "--", name+".d"); len(tracked) > 0 {
+		paths = append(paths, name+".d")
+	}
+	return paths
+}
+
+// excludeBackups adds the backups and the lock file of the vault file base to
+// the excludes of the repository, so that they are neither shown nor added
+// by git.
+func excludeBackups(base string) {
+	path := mustGit("rev-parse", "--git-path", "info/exclude")
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(absPath(dbpath)), path)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		exitOnError(err.Error())
+	}
+
+	var add []string
+	for _, pattern := range []string{base + ".*.bak", base + ".sav", base + ".lock"} {
+		if !strings.Contains("\n"+string(content), "\n"+pattern+"\n") {
+			add = append(add, pattern)
+		}
+	}
+	if len(add) == 0 {
+		return
+	}
+	if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+		content = append(content, '\n')
+	}
+	content = append(content, "# keybox\n"+strings.Join(add, "\n")+"\n"...)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		exitOnError(err.Error())
+	}
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		exitOnError(fmt.Sprintf("Cannot exclude the backups in %s: %s", path, err))
+	}
+}
+
+// openVersion decrypts another version of the vault. The key of the loaded
+// vault is tried first, the passphrase of the version is asked for if it
+// differs.
+func openVersion(content []byte, what string) (*vault.Vault, error) {
+	v, err := vault.Load(content)
+	if err != nil {
+		return nil, err
+	}
+	if v.Version() == vault.FormatV1 {
+		return nil, fmt.Errorf("The %s version is a v1 file, open it once with keybox to upgrade it", what)
+	}
+
+	err = v.UnlockKey(db.Key())
+	if err == vault.ErrWrongPassword && v.Team() {
+		var ids []age.Identity
+		if ids, err = loadIdentities(); err == nil {
+			err = v.UnlockIdentities(ids...)
+		}
+	}
+	for try := 1; err == vault.ErrWrongPassword && !v.Team() && try <= maxPassphraseTries; try++ {
+		passphrase, rerr := readInput(fmt.Sprintf("Passphrase of the %s version", what), true)
+		if rerr != nil {
+			return nil, rerr
+		}
+		err = v.Unlock(passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// git runs git in the directory of the vault and returns its output.
+func git(args ...string) (string, error) {
+	out, err := gitOutput(args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+func gitOutput(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", filepath.Dir(absPath(dbpath))}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); len(msg) > 0 {
+			return nil, fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("git %s: %s", args[0], err)
+	}
+	return out, nil
+}
+
+func mustGit(args ...string) string {
+	out, err := git(args...)
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	return out
+}
+
+// gitShow returns the vault file as committed in rev, nil if it is not.
+func gitShow(rev, name string) []byte {
+	if _, err := git("cat-file", "-e", rev+":"+name); err != nil {
+		return nil
+	}
+	out, err := gitOutput("show", rev+":"+name)
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	return out
+}
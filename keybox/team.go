@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"filippo.io/age"
+	"github.com/goofy-coder/Go/keybox/vault"
+)
+
+// A team vault has no passphrase, see vault.Team. Each member opens it with
+// their own age identity.
+
+// vaultIdentity is the identity file configured for the selected vault.
+var vaultIdentity string
+
+// identityPath is KEYBOX_IDENTITY, the identity of the vault in the config,
+// or identity.txt in the user config directory.
+func identityPath() (string, error) {
+	if p := os.Getenv("KEYBOX_IDENTITY"); len(p) > 0 {
+		return p, nil
+	}
+	if len(vaultIdentity) > 0 {
+		return vaultIdentity, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "keybox", "identity.txt"), nil
+}
+
+// loadIdentities reads the age identity file.
+func loadIdentities() ([]age.Identity, error) {
+	path, err := identityPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read your identity: %s, create one with keybox member keygen", err)
+	}
+	defer f.Close()
+	return age.ParseIdentities(f)
+}
+
+// ownsRecipient reports whether recipient is the public key of one of the
+// local identities.
+func ownsRecipient(recipient string) bool {
+	ids, err := loadIdentities()
+	if err != nil {
+		return false
+	}
+	for _, id := range ids {
+		if x, ok := id.(*age.X25519Identity); ok && x.Recipient().String() == recipient {
+			return true
+		}
+	}
+	return false
+}
+
+// manageMembers lists, adds and removes the members of a team vault. Adding
+// the first member turns a passphrase vault into a team vault.
+func manageMembers(args []string) {
+	usage := "Usage: keybox member {list | add <name> <age1...> | remove <name> | keygen}"
+	if len(args) == 0 {
+		exitOnError(usage)
+	}
+
+	switch {
+	case args[0] == "keygen" && len(args) == 1:
+		generateIdentity()
+	case args[0] == "list" && len(args) == 1:
+		loadDBFile()
+		if !db.Team() {
+			fmt.Println("Not a team vault, it is opened with a passphrase")
+			return
+		}
+		for _, m := range db.Members() {
+			you := ""
+			if ownsRecipient(m.Recipient) {
+				you = " (you)"
+			}
+			fmt.Printf("%-15s %s  added %s%s\n", m.Name, m.Recipient, m.Added.Format("2006-01-02"), you)
+		}
+	case args[0] == "add" && len(args) == 3:
+		addMember(args[1], args[2])
+	case args[0] == "remove" && len(args) == 2:
+		removeMember(args[1])
+	default:
+		exitOnError(usage)
+	}
+}
+
+func addMember(name, recipient string) {
+	if _, err := age.ParseX25519Recipient(recipient); err != nil {
+		exitOnError(fmt.Sprintf("Invalid age recipient %s: %s", recipient, err))
+	}
+
+	lockDBFile()
+	loadDBFile()
+
+	if !db.Team() {
+		// the vault would be lost if nobody could open it
+		if !ownsRecipient(recipient) {
+			exitOnError("The first member of a team vault must be you, add the recipient printed by keybox member keygen")
+		}
+		if !confirm("Turn this vault into a team vault? The passphrase will no longer open it") {
+			return
+		}
+		if err := db.MakeTeam(); err != nil {
+			exitOnError(err.Error())
+		}
+	}
+
+	if err := db.AddMember(vault.Member{Name: name, Recipient: recipient, Added: time.Now()}); err != nil {
+		exitOnError(err.Error())
+	}
+	db.LogOp("member-add", name)
+
+	saveDBFile()
+	agentPutKey(db.Key())
+	fmt.Printf("Added %s\n", name)
+}
+
+func removeMember(name string) {
+	lockDBFile()
+	loadDBFile()
+
+	if !db.Team() {
+		exitOnError("Not a team vault")
+	}
+	found, mine := false, false
+	for _, m := range db.Members() {
+		if m.Name == name {
+			found = true
+		} else {
+			mine = mine || ownsRecipient(m.Recipient)
+		}
+	}
+	if !found {
+		exitOnError(fmt.Sprintf("Member %s not found", name))
+	}
+	if !mine {
+		exitOnError(fmt.Sprintf("Removing %s would leave you out of the vault", name))
+	}
+
+	// the data key and the attachment keys are replaced, the removed member
+	// knows the old ones
+	if err := db.RemoveMember(name); err != nil {
+		exitOnError(err.Error())
+	}
+	db.LogOp("member-remove", name)
+
+	saveDBFile()
+	agentPutKey(db.Key())
+	fmt.Printf("Removed %s and replaced the data key and the attachment keys. %s can still open older copies and backups, change the passwords they knew.\n", name, name)
+}
+
+// generateIdentity creates the identity file and prints its public key.
+func generateIdentity() {
+	path, err := identityPath()
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	if _, err := os.Stat(path); err == nil {
+		exitOnError(fmt.Sprintf("%s exists already", path))
+	}
+
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	content := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n", time.Now().Format(time.RFC3339), id.Recipient(), id)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		exitOnError(err.Error())
+	}
+	if err := vault.WriteFileAtomic(path, []byte(content), 0600); err != nil {
+		exitOnError(fmt.Sprintf("Cannot save %s: %s", path, err))
+	}
+	fmt.Fprintf(os.Stderr, "Identity saved to %s, your public key is\n", path)
+	fmt.Println(id.Recipient())
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// useIdentity writes a new identity file and points KEYBOX_IDENTITY to it.
+func useIdentity(t *testing.T) *age.X25519Identity {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "identity.txt")
+	if err := ioutil.WriteFile(path, []byte(id.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("KEYBOX_IDENTITY", path)
+	return id
+}
+
+func TestOwnsRecipient(t *testing.T) {
+	defer os.Unsetenv("KEYBOX_IDENTITY")
+	alice := useIdentity(t)
+	bob := useIdentity(t)
+
+	// bob's identity is in use
+	if !ownsRecipient(bob.Recipient().String()) || ownsRecipient(alice.Recipient().String()) {
+		t.Error("ownsRecipient does not match the identity file")
+	}
+}
@@ -0,0 +1,709 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// The terminal UI draws with plain ANSI escape sequences on the alternate
+// screen and reads the keys in raw mode. It works on the keys loaded by
+// loadDBFile through db.Put and db.Delete and saves with saveDBFile, like
+// the other commands.
+
+const (
+	tuiHelp       = "/ search  enter details  n new  g generate  c copy  l copy login  r reveal  d delete  u undo  s save  q quit"
+	tuiDetailHelp = "up/down field  enter edit  c copy  g generate  r reveal  u undo  esc back"
+	tuiClearAfter = 30 * time.Second
+)
+
+// tuiKey is a key press: a printable character, or the name of a special
+// key such as "up", "enter" or "ctrl-c".
+type tuiKey struct {
+	Rune rune
+	Name string
+}
+
+var escapeKeys = map[string]string{
+	"[A": "up", "[B": "down", "[C": "right", "[D": "left",
+	"OA": "up", "OB": "down", "OC": "right", "OD": "left",
+	"[H": "home", "[F": "end", "OH": "home", "OF": "end",
+	"[1~": "home", "[4~": "end", "[3~": "delete", "[5~": "pgup", "[6~": "pgdn",
+}
+
+// parseKeys decodes the bytes read from a terminal in raw mode.
+func parseKeys(b []byte) []tuiKey {
+	var keys []tuiKey
+	for len(b) > 0 {
+		c := b[0]
+		switch {
+		case c == 0x1b:
+			name, n := parseEscape(b[1:])
+			keys = append(keys, tuiKey{Name: name})
+			b = b[1+n:]
+			continue
+		case c == '\r' || c == '\n':
+			keys = append(keys, tuiKey{Name: "enter"})
+		case c == 0x7f || c == 0x08:
+			keys = append(keys, tuiKey{Name: "backspace"})
+		case c == '\t':
+			keys = append(keys, tuiKey{Name: "tab"})
+		case c < 0x20:
+			keys = append(keys, tuiKey{Name: "ctrl-" + string(rune('a'+c-1))})
+		default:
+			r, n := utf8.DecodeRune(b)
+			keys = append(keys, tuiKey{Rune: r})
+			b = b[n:]
+			continue
+		}
+		b = b[1:]
+	}
+	return keys
+}
+
+// parseEscape decodes the escape sequence following ESC and returns its
+// length. An unknown sequence or a lone ESC is the escape key.
+func parseEscape(b []byte) (string, int) {
+	if len(b) < 2 || b[0] != '[' && b[0] != 'O' {
+		return "esc", 0
+	}
+	// CSI parameters are digits and ;, the final byte ends the sequence
+	n := 1
+	for n < len(b) && (b[n] >= '0' && b[n] <= '9' || b[n] == ';') {
+		n++
+	}
+	if n == len(b) {
+		return "esc", 0
+	}
+	if name, found := escapeKeys[string(b[:n+1])]; found {
+		return name, n + 1
+	}
+	return "unknown", n + 1
+}
+
+// lineEditor edits a single line of text at the bottom of the screen.
+type lineEditor struct {
+	prompt string
+	buf    []rune
+	pos    int
+	hidden bool
+}
+
+func newLineEditor(prompt, value string, hidden bool) *lineEditor {
+	buf := []rune(value)
+	return &lineEditor{prompt: prompt, buf: buf, pos: len(buf), hidden: hidden}
+}
+
+// handle applies k and reports whether the line was entered or cancelled.
+func (e *lineEditor) handle(k tuiKey) (entered, cancelled bool) {
+	switch k.Name {
+	case "enter":
+		return true, false
+	case "esc", "ctrl-c":
+		return false, true
+	case "backspace":
+		if e.pos > 0 {
+			e.buf = append(e.buf[:e.pos-1], e.buf[e.pos:]...)
+			e.pos--
+		}
+	case "delete", "ctrl-d":
+		if e.pos < len(e.buf) {
+			e.buf = append(e.buf[:e.pos], e.buf[e.pos+1:]...)
+		}
+	case "left", "ctrl-b":
+		if e.pos > 0 {
+			e.pos--
+		}
+	case "right", "ctrl-f":
+		if e.pos < len(e.buf) {
+			e.pos++
+		}
+	case "home", "ctrl-a":
+		e.pos = 0
+	case "end", "ctrl-e":
+		e.pos = len(e.buf)
+	case "ctrl-u":
+		e.buf, e.pos = e.buf[e.pos:], 0
+	case "ctrl-k":
+		e.buf = e.buf[:e.pos]
+	case "":
+		e.buf = append(e.buf[:e.pos], append([]rune{k.Rune}, e.buf[e.pos:]...)...)
+		e.pos++
+	}
+	return false, false
+}
+
+func (e *lineEditor) value() string {
+	return string(e.buf)
+}
+
+func (e *lineEditor) display() string {
+	if e.hidden {
+		return e.prompt + strings.Repeat("*", len(e.buf))
+	}
+	return e.prompt + string(e.buf)
+}
+
+// tuiRow is a line of the detail pane. Rows without set are read only.
+type tuiRow struct {
+	label  string
+	value  string
+	secret bool
+	set    func(k *key, v string)
+}
+
+func detailRows(k key) []tuiRow {
+	rows := []tuiRow{
+		{label: "Name", value: k.Name, set: func(k *key, v string) { k.Name = v }},
+		{label: "Login", value: k.Login, set: func(k *key, v string) { k.Login = v }},
+		{label: "Password", value: k.Password, secret: true, set: func(k *key, v string) { k.Password = v }},
+		{label: "URL", value: k.URL, set: func(k *key, v string) { k.URL = v }},
+		{label: "Notes", value: k.Notes, set: func(k *key, v string) { k.Notes = v }},
+		{label: "Tags", value: strings.Join(k.Tags, ", "), set: func(k *key, v string) { k.Tags = parseTags(v) }},
+	}
+	for i, f := range k.Fields {
+		i := i
+		rows = append(rows, tuiRow{label: f.Name, value: f.Value, secret: f.Type == "hidden", set: func(k *key, v string) {
+			k.Fields = append([]field(nil), k.Fields...)
+			k.Fields[i].Value = v
+		}})
+	}
+	if k.OTP != nil {
+		value := k.OTP.Type
+		if code, valid, err := k.OTP.Code(time.Now()); err == nil && k.OTP.Type == "totp" {
+			value = fmt.Sprintf("%s (%ds)", code, int(valid.Seconds()))
+		}
+		rows = append(rows, tuiRow{label: "OTP", value: value})
+	}
+	if k.SSH != nil {
+		value := "invalid key"
+		if pub, err := k.SSH.PublicKey(); err == nil {
+			value = fmt.Sprintf("%s, lifetime %s", ssh.FingerprintSHA256(pub), sshLifetime(k.SSH))
+			if k.SSH.Confirm {
+				value += ", confirm"
+			}
+		}
+		rows = append(rows, tuiRow{label: "SSH", value: value})
+	}
+	for _, a := range k.Attachments {
+		rows = append(rows, tuiRow{label: "Attachment", value: fmt.Sprintf("%s, %d bytes", a.Name, a.Size)})
+	}
+	rows = append(rows,
+		tuiRow{label: "Created", value: k.Created.Format(time.RFC3339)},
+		tuiRow{label: "Modified", value: k.Modified.Format(time.RFC3339)})
+	return rows
+}
+
+// keySnapshot is a key as it was before a change, to undo it.
+type keySnapshot struct {
+	name    string
+	key     key
+	existed bool
+}
+
+type tui struct {
+	width, height int
+
+	names    []string
+	query    string
+	selected int
+	offset   int
+
+	detail bool // the detail pane has the focus
+	row    int
+	reveal bool
+
+	input   *lineEditor
+	entered func(string)
+	changed func(string)
+
+	undo        [][]keySnapshot
+	dirty       bool
+	confirmQuit bool
+	status      string
+	quit        bool
+}
+
+func newTUI() *tui {
+	t := &tui{width: 80, height: 24}
+	t.refresh("")
+	return t
+}
+
+// refresh filters the keys again and keeps name selected if it is listed.
+func (t *tui) refresh(name string) {
+	if len(t.query) > 0 {
+		t.names = searchKeys(t.query, keyFilter{})
+	} else {
+		t.names = db.Names()
+	}
+
+	for i, n := range t.names {
+		if n == name {
+			t.selected = i
+		}
+	}
+	if t.selected >= len(t.names) {
+		t.selected = len(t.names) - 1
+	}
+	if t.selected < 0 {
+		t.selected = 0
+	}
+}
+
+func (t *tui) current() (key, bool) {
+	if len(t.names) == 0 {
+		return key{}, false
+	}
+	k, found := db.Get(t.names[t.selected])
+	return k, found
+}
+
+// record saves the keys about to be changed so that the change can be
+// undone.
+func (t *tui) record(names ...string) {
+	var snaps []keySnapshot
+	for _, name := range names {
+		k, found := db.Get(name)
+		snaps = append(snaps, keySnapshot{name, k, found})
+	}
+	t.undo = append(t.undo, snaps)
+	t.dirty = true
+}
+
+func (t *tui) undoLast() {
+	if len(t.undo) == 0 {
+		t.status = "Nothing to undo"
+		return
+	}
+
+	snaps := t.undo[len(t.undo)-1]
+	t.undo = t.undo[:len(t.undo)-1]
+	for i := len(snaps) - 1; i >= 0; i-- {
+		s := snaps[i]
+		if s.existed {
+			db.Store(s.key)
+		} else {
+			db.Delete(s.name)
+		}
+		db.LogOp("undo", s.name)
+	}
+	t.refresh(snaps[0].name)
+	// back to the saved keys once everything is undone
+	t.dirty = len(t.undo) > 0
+	t.status = "Undone"
+}
+
+// ask opens the line editor, entered is called with the line unless it is
+// cancelled.
+func (t *tui) ask(prompt, value string, hidden bool, entered func(string)) {
+	t.input = newLineEditor(prompt, value, hidden)
+	t.entered, t.changed = entered, nil
+}
+
+func (t *tui) handle(k tuiKey) {
+	t.status = ""
+
+	if t.input != nil {
+		entered, cancelled := t.input.handle(k)
+		v, onEnter, onChange := t.input.value(), t.entered, t.changed
+		if entered || cancelled {
+			t.input, t.entered, t.changed = nil, nil, nil
+		}
+		switch {
+		case cancelled && onChange != nil:
+			onChange("")
+		case entered && onEnter != nil:
+			onEnter(v)
+		case !entered && !cancelled && onChange != nil:
+			onChange(v)
+		}
+		return
+	}
+
+	if k.Name == "ctrl-c" || k.Rune == 'q' {
+		if t.dirty && !t.confirmQuit {
+			t.confirmQuit = true
+			t.status = "Unsaved changes, s to save or q again to quit without saving"
+			return
+		}
+		t.quit = true
+		return
+	}
+	t.confirmQuit = false
+
+	if t.detail {
+		t.handleDetail(k)
+	} else {
+		t.handleList(k)
+	}
+}
+
+func (t *tui) handleList(k tuiKey) {
+	page := t.height - 3
+	switch {
+	case k.Name == "up" || k.Rune == 'k':
+		t.selected--
+	case k.Name == "down" || k.Rune == 'j':
+		t.selected++
+	case k.Name == "pgup":
+		t.selected -= page
+	case k.Name == "pgdn":
+		t.selected += page
+	case k.Name == "home":
+		t.selected = 0
+	case k.Name == "end":
+		t.selected = len(t.names) - 1
+	case k.Name == "enter" || k.Name == "right" || k.Name == "tab":
+		if _, found := t.current(); found {
+			t.detail, t.row = true, 0
+		}
+	case k.Name == "esc":
+		t.query = ""
+		t.refresh(t.selectedName())
+	case k.Rune == '/':
+		name := t.selectedName()
+		t.input = newLineEditor("/", t.query, false)
+		t.changed = func(q string) {
+			t.query = q
+			t.refresh(name)
+		}
+		t.entered = t.changed
+	case k.Rune == 'n':
+		t.ask("New key name: ", "", false, t.newKey)
+	case k.Rune == 'd':
+		if cur, found := t.current(); found {
+			t.ask(fmt.Sprintf("Delete %s? [y/N] ", cur.Name), "", false, func(v string) {
+				if strings.EqualFold(v, "y") || strings.EqualFold(v, "yes") {
+					t.record(cur.Name)
+					db.Delete(cur.Name)
+					t.refresh("")
+					t.status = "Deleted " + cur.Name
+				}
+			})
+		}
+	default:
+		t.handleCommon(k)
+	}
+
+	if t.selected >= len(t.names) {
+		t.selected = len(t.names) - 1
+	}
+	if t.selected < 0 {
+		t.selected = 0
+	}
+}
+
+func (t *tui) handleDetail(k tuiKey) {
+	cur, found := t.current()
+	if !found {
+		t.detail = false
+		return
+	}
+	rows := detailRows(cur)
+
+	switch {
+	case k.Name == "up" || k.Rune == 'k':
+		if t.row > 0 {
+			t.row--
+		}
+	case k.Name == "down" || k.Rune == 'j':
+		if t.row < len(rows)-1 {
+			t.row++
+		}
+	case k.Name == "esc" || k.Name == "left":
+		t.detail = false
+	case k.Name == "enter" || k.Rune == 'e':
+		row := rows[t.row]
+		if row.set == nil {
+			t.status = row.label + " is read only"
+			return
+		}
+		t.ask(row.label+": ", row.value, row.secret && !t.reveal, func(v string) {
+			t.edit(cur, row, v)
+		})
+	case k.Rune == 'c' && t.row < len(rows):
+		t.copy(rows[t.row].label, rows[t.row].value)
+	default:
+		t.handleCommon(k)
+	}
+}
+
+// handleCommon handles the keys that work in both panes.
+func (t *tui) handleCommon(k tuiKey) {
+	cur, found := t.current()
+	switch k.Rune {
+	case 'r':
+		t.reveal = !t.reveal
+	case 'u':
+		t.undoLast()
+	case 's':
+		t.save()
+	case 'c':
+		if found {
+			t.copy("password", cur.Password)
+		}
+	case 'l':
+		if found {
+			t.copy("login", cur.Login)
+		}
+	case 'g':
+		if !found {
+			return
+		}
+		t.ask(fmt.Sprintf("Generate a new password for %s? [y/N] ", cur.Name), "", false, func(v string) {
+			if !strings.EqualFold(v, "y") && !strings.EqualFold(v, "yes") {
+				return
+			}
+			pw, err := generatePassword(passwordPresets["default"])
+			if err != nil {
+				t.status = err.Error()
+				return
+			}
+			t.record(cur.Name)
+			cur.Password = pw
+			db.Put(cur)
+			t.status = "New password generated for " + cur.Name
+		})
+	}
+}
+
+func (t *tui) selectedName() string {
+	if k, found := t.current(); found {
+		return k.Name
+	}
+	return ""
+}
+
+func (t *tui) newKey(name string) {
+	if len(name) == 0 {
+		return
+	}
+	if _, found := db.Get(name); found {
+		t.status = fmt.Sprintf("Key %s exists already", name)
+		return
+	}
+
+	pw, err := generatePassword(passwordPresets["default"])
+	if err != nil {
+		t.status = err.Error()
+		return
+	}
+	t.record(name)
+	db.Put(key{Name: name, Password: pw})
+	t.query = ""
+	t.refresh(name)
+	t.detail, t.row = true, 1
+	t.status = "Created " + name + " with a generated password"
+}
+
+// edit sets a field of k, renaming the key when the field is the name.
+func (t *tui) edit(k key, row tuiRow, v string) {
+	if v == row.value {
+		return
+	}
+
+	old := k.Name
+	row.set(&k, v)
+	if k.Name == old {
+		t.record(old)
+		db.Put(k)
+		t.status = fmt.Sprintf("%s of %s changed", row.label, old)
+		return
+	}
+
+	if len(k.Name) == 0 {
+		t.status = "Empty name"
+		return
+	}
+	if _, found := db.Get(k.Name); found {
+		t.status = fmt.Sprintf("Key %s exists already", k.Name)
+		return
+	}
+	t.record(old, k.Name)
+	db.Delete(old)
+	db.Put(k)
+	renamed, _ := db.Get(k.Name)
+	renamed.Created = k.Created
+	db.Store(renamed)
+	t.refresh(k.Name)
+	t.status = fmt.Sprintf("Renamed %s to %s", old, k.Name)
+}
+
+func (t *tui) copy(what, text string) {
+	name := clipboardName()
+	if err := getClipboard(name).copy(text); err != nil {
+		t.status = fmt.Sprintf("Cannot copy to the clipboard with %s: %s", name, err)
+		return
+	}
+	if err := startClipboardClearer(name, text, tuiClearAfter); err != nil {
+		t.status = fmt.Sprintf("Copied %s, but cannot clear the clipboard: %s", what, err)
+		return
+	}
+	t.status = fmt.Sprintf("Copied %s, clearing the clipboard in %s", what, tuiClearAfter)
+}
+
+func (t *tui) save() {
+	if !t.dirty {
+		t.status = "No changes"
+		return
+	}
+	saveDBFile()
+	t.dirty, t.undo = false, nil
+	t.status = "Saved"
+}
+
+// render draws the whole screen.
+func (t *tui) render() []byte {
+	var b bytes.Buffer
+	b.WriteString("\x1b[H")
+
+	title := " keybox  " + dbpath
+	if t.dirty {
+		title += "  [modified]"
+	}
+	writeLine(&b, "\x1b[7m", title, t.width)
+
+	listWidth := t.width / 3
+	if listWidth > 32 {
+		listWidth = 32
+	}
+	detailWidth := t.width - listWidth - 3
+
+	page := t.height - 3
+	if t.selected < t.offset {
+		t.offset = t.selected
+	}
+	if t.selected >= t.offset+page {
+		t.offset = t.selected - page + 1
+	}
+
+	var rows []tuiRow
+	if cur, found := t.current(); found {
+		rows = detailRows(cur)
+	}
+
+	for i := 0; i < page; i++ {
+		b.WriteString("\x1b[2K")
+
+		if n := t.offset + i; n < len(t.names) {
+			style := ""
+			if n == t.selected {
+				style = "\x1b[7m"
+				if t.detail {
+					style = "\x1b[1m"
+				}
+			}
+			b.WriteString(style + " " + fit(t.names[n], listWidth-1) + "\x1b[0m")
+		} else {
+			b.WriteString(strings.Repeat(" ", listWidth))
+		}
+		b.WriteString(" │ ")
+
+		if i < len(rows) {
+			r := rows[i]
+			v := r.value
+			if r.secret && !t.reveal {
+				v = passwordMask
+			}
+			style := ""
+			if t.detail && i == t.row {
+				style = "\x1b[7m"
+			}
+			b.WriteString(style + fit(fmt.Sprintf("%-10s %s", r.label, v), detailWidth) + "\x1b[0m")
+		}
+		b.WriteString("\r\n")
+	}
+
+	switch {
+	case t.input != nil:
+		writeLine(&b, "", t.input.display(), t.width)
+	case len(t.query) > 0:
+		writeLine(&b, "", fmt.Sprintf("/%s  (%d matches, esc to clear)", t.query, len(t.names)), t.width)
+	default:
+		writeLine(&b, "", "", t.width)
+	}
+
+	help := tuiHelp
+	if t.detail {
+		help = tuiDetailHelp
+	}
+	if len(t.status) > 0 {
+		help = t.status
+	}
+	b.WriteString("\x1b[2K\x1b[7m" + fit(help, t.width) + "\x1b[0m")
+
+	if t.input != nil {
+		col := utf8.RuneCountInString(t.input.prompt) + t.input.pos + 1
+		fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", t.height-1, col)
+	} else {
+		b.WriteString("\x1b[?25l")
+	}
+	return b.Bytes()
+}
+
+func writeLine(b *bytes.Buffer, style, s string, width int) {
+	b.WriteString("\x1b[2K" + style + fit(s, width) + "\x1b[0m\r\n")
+}
+
+// fit truncates or pads s to width columns.
+func fit(s string, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	r := []rune(s)
+	if len(r) > width {
+		return string(r[:width-1]) + "…"
+	}
+	return s + strings.Repeat(" ", width-len(r))
+}
+
+func runTUI(args []string) {
+	fs := flag.NewFlagSet("tui", flag.ExitOnError)
+	fs.Parse(args)
+
+	in, out := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !term.IsTerminal(in) || !term.IsTerminal(out) {
+		exitOnError("keybox tui needs a terminal")
+	}
+
+	lockDBFile()
+	loadDBFile()
+
+	state, err := term.MakeRaw(in)
+	if err != nil {
+		exitOnError(fmt.Sprintf("Cannot set up the terminal: %s", err))
+	}
+	restore := func() {
+		os.Stdout.WriteString("\x1b[0m\x1b[?25h\x1b[?1049l")
+		term.Restore(in, state)
+	}
+	// exitOnError may be called by saveDBFile
+	onExit = restore
+	defer restore()
+	os.Stdout.WriteString("\x1b[?1049h\x1b[2J")
+
+	t := newTUI()
+	buf := make([]byte, 256)
+	for !t.quit {
+		if w, h, err := term.GetSize(out); err == nil && w > 0 && h > 0 {
+			t.width, t.height = w, h
+		}
+		os.Stdout.Write(t.render())
+
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			break
+		}
+		for _, k := range parseKeys(buf[:n]) {
+			t.handle(k)
+		}
+	}
+}
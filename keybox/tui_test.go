@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	got := parseKeys([]byte("aé\r\x1b[A\x1b[6~\x1bOB\x7f\x03\x1b"))
+	want := []tuiKey{
+		{Rune: 'a'}, {Rune: 'é'}, {Name: "enter"}, {Name: "up"}, {Name: "pgdn"},
+		{Name: "down"}, {Name: "backspace"}, {Name: "ctrl-c"}, {Name: "esc"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	e := newLineEditor("> ", "helo", false)
+	for _, k := range parseKeys([]byte("\x1b[D\x1b[Dl\x1b[Fs")) {
+		e.handle(k)
+	}
+	if e.value() != "hellos" {
+		t.Errorf("got %q", e.value())
+	}
+	e.handle(tuiKey{Name: "ctrl-u"})
+	if e.value() != "" {
+		t.Errorf("ctrl-u left %q", e.value())
+	}
+	if entered, _ := e.handle(tuiKey{Name: "enter"}); !entered {
+		t.Error("enter not reported")
+	}
+}
+
+func typeKeys(t *tui, s string) {
+	for _, k := range parseKeys([]byte(s)) {
+		t.handle(k)
+	}
+}
+
+func TestTUIEditUndo(t *testing.T) {
+	useKeys(t,
+		key{Name: "github", Login: "me", Password: "old"},
+		key{Name: "gitlab", Login: "me"},
+		key{Name: "bank", Login: "12345"},
+	)
+	ui := newTUI()
+
+	// search, open the details and change the login
+	typeKeys(ui, "/glab\r")
+	if !reflect.DeepEqual(ui.names, []string{"gitlab"}) {
+		t.Fatalf("search listed %v", ui.names)
+	}
+	typeKeys(ui, "\r\x1b[B\r\x15you\r")
+	if k, _ := db.Get("gitlab"); k.Login != "you" || !ui.dirty {
+		t.Errorf("login not changed: %+v", k)
+	}
+
+	// rename, then undo both changes
+	typeKeys(ui, "\x1b[A\r\x15gitlab.com\r")
+	if _, found := db.Get("gitlab.com"); !found || db.Len() != 3 {
+		t.Fatalf("rename failed: %v", db.Names())
+	}
+	typeKeys(ui, "uu")
+	k, _ := db.Get("gitlab")
+	if _, found := db.Get("gitlab.com"); found || k.Login != "me" || ui.dirty {
+		t.Errorf("undo failed: %v, dirty %v", db.List(), ui.dirty)
+	}
+
+	// leave the details, clear the search and delete the first key
+	typeKeys(ui, "\x1b\x1b")
+	if len(ui.names) != 3 {
+		t.Fatalf("search not cleared: %v", ui.names)
+	}
+	typeKeys(ui, "\x1b[Hdy\r")
+	if _, found := db.Get("bank"); found {
+		t.Error("bank not deleted")
+	}
+
+	// q asks first when there are unsaved changes
+	typeKeys(ui, "q")
+	if ui.quit {
+		t.Error("quit with unsaved changes")
+	}
+	typeKeys(ui, "q")
+	if !ui.quit {
+		t.Error("second q did not quit")
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/goofy-coder/Go/keybox/vault"
+)
+
+// The named vaults live in a JSON config file, by default
+// $XDG_CONFIG_HOME/keybox/config.json:
+//
+//	{"Current": "personal", "Vaults": {"personal": {"Path": "/home/me/personal.kbox"}}}
+//
+// The vault to work on is given by -vault, else by KEYBOXFILE, else it is the
+// current one picked with keybox use.
+
+type vaultConfig struct {
+	Path     string
+	Identity string `json:",omitempty"` // age identity file of a team vault
+}
+
+type config struct {
+	Current string `json:",omitempty"`
+	Vaults  map[string]vaultConfig
+	Clients map[string]*apiClient `json:",omitempty"` // paired with keybox serve
+}
+
+var vaultName = flag.String("vault", "", "name or path of the vault to use")
+
+// configPath is KEYBOX_CONFIG or config.json in the user config directory.
+func configPath() (string, error) {
+	if p := os.Getenv("KEYBOX_CONFIG"); len(p) > 0 {
+		return p, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "keybox", "config.json"), nil
+}
+
+// loadConfig reads the config file. A missing file is an empty config.
+func loadConfig() (*config, error) {
+	c := &config{Vaults: make(map[string]vaultConfig)}
+
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, c); err != nil {
+		return nil, fmt.Errorf("Invalid config %s: %s", path, err)
+	}
+	if c.Vaults == nil {
+		c.Vaults = make(map[string]vaultConfig)
+	}
+	return c, nil
+}
+
+func (c *config) save() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return vault.WriteFileAtomic(path, append(content, '\n'), 0600)
+}
+
+// resolve returns the path of the vault name, which may also be a path. An
+// empty name picks KEYBOXFILE or the current vault.
+func (c *config) resolve(name string) (string, error) {
+	if len(name) == 0 {
+		if p := os.Getenv("KEYBOXFILE"); len(p) > 0 {
+			return p, nil
+		}
+		name = c.Current
+	}
+	if len(name) == 0 {
+		return "", errors.New("No vault selected, set KEYBOXFILE, pass -vault or add one with keybox vault add")
+	}
+
+	if v, found := c.Vaults[name]; found {
+		return v.Path, nil
+	}
+	if strings.ContainsRune(name, '/') || strings.ContainsRune(name, filepath.Separator) || !isVaultFile(name) {
+		return name, nil
+	}
+	return "", fmt.Errorf("Unknown vault %s, expected one of %s", name, strings.Join(c.names(), ", "))
+}
+
+func (c *config) clientNames() []string {
+	names := make([]string, 0, len(c.Clients))
+	for name := range c.Clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *config) names() []string {
+	names := make([]string, 0, len(c.Vaults))
+	for name := range c.Vaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectVault sets dbpath to the vault picked by -vault, KEYBOXFILE or the
+// config.
+func selectVault() {
+	c, err := loadConfig()
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	if dbpath, err = c.resolve(*vaultName); err != nil {
+		exitOnError(err.Error())
+	}
+	vaultIdentity = c.identityFor(dbpath)
+}
+
+// identityFor returns the identity file configured for the vault at path.
+func (c *config) identityFor(path string) string {
+	for _, v := range c.Vaults {
+		if absPath(v.Path) == absPath(path) {
+			return v.Identity
+		}
+	}
+	return ""
+}
+
+// listVaults prints the configured vaults, the current one marked with *.
+func listVaults(c *config) {
+	for _, name := range c.names() {
+		mark := " "
+		if name == c.Current {
+			mark = "*"
+		}
+		fmt.Printf("%s %-15s %s\n", mark, name, c.Vaults[name].Path)
+	}
+}
+
+// manageVaults adds, removes and lists the named vaults.
+func manageVaults(args []string) {
+	usage := "Usage: keybox vault {add <name> <path> [identity file] | rm <name> | list}"
+	if len(args) == 0 {
+		exitOnError(usage)
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		exitOnError(err.Error())
+	}
+
+	switch {
+	case args[0] == "add" && (len(args) == 3 || len(args) == 4):
+		name := args[1]
+		if _, found := c.Vaults[name]; found {
+			exitOnError(fmt.Sprintf("Vault %s exists already", name))
+		}
+		if strings.ContainsAny(name, "/"+string(filepath.Separator)) {
+			exitOnError(fmt.Sprintf("Invalid vault name %s", name))
+		}
+		v := vaultConfig{Path: absPath(args[2])}
+		if len(args) == 4 {
+			var err error
+			if v.Identity, err = filepath.Abs(args[3]); err != nil {
+				exitOnError(err.Error())
+			}
+		}
+		c.Vaults[name] = v
+		if len(c.Current) == 0 {
+			c.Current = name
+		}
+	case args[0] == "rm" && len(args) == 2:
+		if _, found := c.Vaults[args[1]]; !found {
+			exitOnError(fmt.Sprintf("Unknown vault %s", args[1]))
+		}
+		// the file itself is left alone
+		delete(c.Vaults, args[1])
+		if c.Current == args[1] {
+			c.Current = ""
+		}
+	case args[0] == "list" && len(args) == 1:
+		listVaults(c)
+		return
+	default:
+		exitOnError(usage)
+	}
+
+	if err := c.save(); err != nil {
+		exitOnError(fmt.Sprintf("Cannot save config: %s", err))
+	}
+}
+
+// useVault makes a named vault the current one.
+func useVault(args []string) {
+	if len(args) != 1 {
+		exitOnError("Usage: keybox use <name>")
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	if _, found := c.Vaults[args[0]]; !found {
+		exitOnError(fmt.Sprintf("Unknown vault %s, add it with keybox vault add", args[0]))
+	}
+	c.Current = args[0]
+	if err := c.save(); err != nil {
+		exitOnError(fmt.Sprintf("Cannot save config: %s", err))
+	}
+	if len(os.Getenv("KEYBOXFILE")) > 0 {
+		fmt.Fprintln(os.Stderr, "KEYBOXFILE is set and takes precedence over the current vault")
+	}
+}
+
+// vaultState is what loadDBFile sets up, kept aside while working on
+// another vault.
+type vaultState struct {
+	path     string
+	db       *vault.Vault
+	identity string
+}
+
+func currentVault() vaultState {
+	return vaultState{dbpath, db, vaultIdentity}
+}
+
+func (s vaultState) use() {
+	dbpath, db, vaultIdentity = s.path, s.db, s.identity
+}
+
+// openVault switches to the vault at path, which still has to be loaded.
+// A passphrase from -passphrase-fd or the environment is used for both.
+func openVault(path, identity string) {
+	vaultState{path: path, identity: identity}.use()
+	if !passphraseGiven() {
+		cachedPassphrase = nil
+	}
+}
+
+// transferKeys copies keys to another vault, or moves them with -move. The
+// destination is saved first, so a failure never loses a key.
+func transferKeys(args []string) {
+	fs := flag.NewFlagSet("transfer", flag.ExitOnError)
+	to := fs.String("to", "", "name or path of the destination vault")
+	move := fs.Bool("move", false, "remove the keys from this vault once copied")
+	policy := fs.String("on-conflict", "skip", "what to do with names that exist already: "+strings.Join(mergePolicies, ", "))
+	names := parseInterspersed(fs, args)
+	if len(names) == 0 || len(*to) == 0 {
+		exitOnError("Usage: keybox transfer -to <vault> [-move] [-on-conflict skip|overwrite|rename] <name>...")
+	}
+	if !validPolicy(*policy) {
+		exitOnError(fmt.Sprintf("Unknown conflict policy %s, expected one of %s", *policy, strings.Join(mergePolicies, ", ")))
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	dest, err := c.resolve(*to)
+	if err != nil {
+		exitOnError(err.Error())
+	}
+	if a, b := absPath(dbpath), absPath(dest); a == b {
+		exitOnError("Source and destination are the same vault")
+	}
+
+	lockDBFile()
+	loadDBFile()
+
+	var transferred []key
+	for _, name := range names {
+		k, found := db.Get(name)
+		if !found {
+			exitOnError(fmt.Sprintf("Key %s not found", name))
+		}
+		transferred = append(transferred, k)
+	}
+	source := currentVault()
+
+	fmt.Fprintf(os.Stderr, "Opening %s\n", dest)
+	openVault(dest, c.identityFor(dest))
+	lockDBFile()
+	loadDBFile()
+	copyAttachments(transferred, source.db)
+
+	db.LogOp("transfer", "from "+source.path)
+	added, updated, skipped := mergeKeys(transferred, *policy)
+	saveDBFile()
+	for _, name := range skipped {
+		fmt.Printf("Skipped %s, it exists in %s\n", name, *to)
+	}
+	fmt.Printf("%d added, %d overwritten, %d skipped\n", added, updated, len(skipped))
+
+	if !*move {
+		return
+	}
+
+	source.use()
+	for _, k := range transferred {
+		if !contains(skipped, k.Name) {
+			db.Delete(k.Name)
+		}
+	}
+	saveDBFile()
+}
+
+// absPath makes the path of a vault absolute, other locations are returned
+// as they are.
+func absPath(path string) string {
+	if !isVaultFile(path) {
+		return path
+	}
+	if a, err := filepath.Abs(path); err == nil {
+		return a
+	}
+	return path
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
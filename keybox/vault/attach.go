@@ -0,0 +1,248 @@
+package vault
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The content of an attachment is not in the payload, only its name, size
+// and the key it is encrypted with. The content is split in chunks of
+// attachmentChunk bytes, the last one being shorter and possibly empty, each
+// sealed with AES-GCM and kept as an object of the store,
+// attachments/<id>/<n>. The nonce of a chunk is its index and whether it is
+// the last one, so that chunks can be neither reordered, dropped nor
+// appended, and no more than a chunk is in memory at a time.
+
+// Attachment is a file attached to a key.
+type Attachment struct {
+	Name  string
+	ID    string
+	Key   []byte // the key the chunks are sealed with
+	Size  int64
+	Added time.Time
+}
+
+const attachmentChunk = 1 << 20
+
+func chunkObject(id string, n int64) string {
+	return fmt.Sprintf("attachments/%s/%d", id, n)
+}
+
+// chunks returns the number of chunks of a.
+func (a Attachment) chunks() int64 {
+	return a.Size/attachmentChunk + 1
+}
+
+func chunkNonce(n int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(n))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Attach encrypts the content of r into new objects of the store and
+// returns the attachment to add to a key as name. The objects are removed
+// again if the vault is not saved with a key holding the attachment.
+func (v *Vault) Attach(name string, r io.Reader) (Attachment, error) {
+	if !v.unlocked {
+		return Attachment{}, ErrNotUnlocked
+	}
+	if v.store == nil {
+		return Attachment{}, fmt.Errorf("Vault has no store to keep attachments in")
+	}
+
+	id, err := newEntryID()
+	if err != nil {
+		return Attachment{}, err
+	}
+	a := Attachment{Name: name, ID: id, Key: make([]byte, 32), Added: time.Now()}
+	if _, err := io.ReadFull(crand.Reader, a.Key); err != nil {
+		return Attachment{}, err
+	}
+	gcm, err := newGCM(a.Key)
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	buf := make([]byte, attachmentChunk)
+	for n := int64(0); ; n++ {
+		read, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err == nil || last {
+			sealed := gcm.Seal(nil, chunkNonce(n, last), buf[:read], []byte("keybox attachment "+id))
+			_, err = v.store.Put(chunkObject(id, n), sealed, "")
+		}
+		if err != nil {
+			a.Size = n * attachmentChunk
+			v.deleteAttachment(a)
+			return Attachment{}, fmt.Errorf("Cannot attach %s: %s", name, err)
+		}
+
+		a.Size += int64(read)
+		if last {
+			break
+		}
+	}
+
+	if v.pending == nil {
+		v.pending = make(map[string]Attachment)
+	}
+	v.pending[id] = a
+	return a, nil
+}
+
+// ReadAttachment decrypts the content of a to w, one chunk at a time. What
+// was written to w before an error is not to be trusted.
+func (v *Vault) ReadAttachment(a Attachment, w io.Writer) error {
+	if !v.unlocked {
+		return ErrNotUnlocked
+	}
+	if v.store == nil {
+		return fmt.Errorf("Vault has no store to keep attachments in")
+	}
+	gcm, err := newGCM(a.Key)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for n, chunks := int64(0), a.chunks(); n < chunks; n++ {
+		sealed, _, err := v.store.Get(chunkObject(a.ID, n))
+		if err == ErrNotFound {
+			return fmt.Errorf("Attachment %s is missing from %s", a.Name, v.store)
+		}
+		if err != nil {
+			return err
+		}
+		chunk, err := gcm.Open(nil, chunkNonce(n, n == chunks-1), sealed, []byte("keybox attachment "+a.ID))
+		if err != nil {
+			return ErrTampered
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		size += int64(len(chunk))
+	}
+	if size != a.Size {
+		return ErrTampered
+	}
+	return nil
+}
+
+// CopyAttachment copies a of the vault from into v, e.g. when a key is
+// transferred, and returns the copy.
+func (v *Vault) CopyAttachment(from *Vault, a Attachment) (Attachment, error) {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(from.ReadAttachment(a, w))
+	}()
+	c, err := v.Attach(a.Name, r)
+	r.Close()
+	c.Added = a.Added
+	return c, err
+}
+
+// rotateAttachments encrypts the attachments of the keys again with new keys
+// and under new ids, for whoever knew the old keys. The old objects are
+// removed once the vault is saved.
+func (v *Vault) rotateAttachments() error {
+	for name, k := range v.keys {
+		if len(k.Attachments) == 0 {
+			continue
+		}
+		as := make([]Attachment, len(k.Attachments))
+		for i, a := range k.Attachments {
+			c, err := v.CopyAttachment(v, a)
+			if err != nil {
+				return fmt.Errorf("Cannot encrypt %s of %s again: %s", a.Name, name, err)
+			}
+			as[i] = c
+		}
+		k.Attachments = as
+		v.keys[name] = k
+	}
+	return nil
+}
+
+// MissingAttachments returns the attachments of the keys, as key/name, that
+// are not complete in s, e.g. to check a backup before it is restored.
+func (v *Vault) MissingAttachments(s Store) ([]string, error) {
+	if !v.unlocked {
+		return nil, ErrNotUnlocked
+	}
+	var missing []string
+	for _, k := range v.List() {
+		for _, a := range k.Attachments {
+			for n, chunks := int64(0), a.chunks(); n < chunks; n++ {
+				_, _, err := s.Get(chunkObject(a.ID, n))
+				if err == ErrNotFound {
+					missing = append(missing, k.Name+"/"+a.Name)
+					break
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return missing, nil
+}
+
+// attachmentKeeper is a store keeping backups of the vault file, which
+// refer to attachments the vault file no longer holds, see FileStore.
+type attachmentKeeper interface {
+	// retireAttachment reports whether the objects of the attachment id are
+	// kept for the backups rather than to be deleted.
+	retireAttachment(id string) bool
+	// keepAttachments is told the attachments in use after a save, to
+	// remove the objects that no backup refers to any more.
+	keepAttachments(live map[string]Attachment)
+}
+
+func (v *Vault) deleteAttachment(a Attachment) {
+	for n, chunks := int64(0), a.chunks(); n < chunks; n++ {
+		v.store.Delete(chunkObject(a.ID, n))
+	}
+}
+
+func attachmentsOf(keys map[string]Key) map[string]Attachment {
+	m := make(map[string]Attachment)
+	for _, k := range keys {
+		for _, a := range k.Attachments {
+			m[a.ID] = a
+		}
+	}
+	return m
+}
+
+// collectAttachments removes the objects of the attachments that the vault
+// file no longer holds, once it is saved, or of those attached since it
+// was loaded if it could not be saved. A store keeping backups removes them
+// once no backup refers to them.
+func (v *Vault) collectAttachments(saved bool) {
+	current := attachmentsOf(v.keys)
+	keeper, keeps := v.store.(attachmentKeeper)
+	if saved {
+		for id, a := range v.saved {
+			if _, found := current[id]; !found && !(keeps && keeper.retireAttachment(id)) {
+				v.deleteAttachment(a)
+			}
+		}
+		v.saved = current
+	}
+	for id, a := range v.pending {
+		if _, found := current[id]; !found || !saved {
+			v.deleteAttachment(a)
+		}
+	}
+	v.pending = nil
+
+	if keeps && saved {
+		keeper.keepAttachments(current)
+	}
+}
@@ -0,0 +1,251 @@
+package vault
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestAttachments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault")
+	chunks := func() []string {
+		names, _ := filepath.Glob(filepath.Join(path+".d", "attachments", "*", "*"))
+		return names
+	}
+
+	// without backups, the chunks go as soon as they are no longer used
+	v, err := Create(&FileStore{Path: path}, &KDFParams{KDF: KDFSHA256}, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string][]byte{"empty": nil, "chunk": make([]byte, attachmentChunk), "large": make([]byte, 2*attachmentChunk+100)}
+	k := Key{Name: "server"}
+	for _, name := range []string{"empty", "chunk", "large"} {
+		crand.Read(contents[name])
+		a, err := v.Attach(name, bytes.NewReader(contents[name]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Size != int64(len(contents[name])) {
+			t.Errorf("%s: size %d, want %d", name, a.Size, len(contents[name]))
+		}
+		k.Attachments = append(k.Attachments, a)
+	}
+	v.Put(k)
+	// attached but never added to a key
+	if _, err := v.Attach("stray", bytes.NewReader([]byte("stray"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(chunks()); n != 1+2+3 {
+		t.Errorf("%d chunks after save, want 6", n)
+	}
+
+	w, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Unlock("pw"); err != nil {
+		t.Fatal(err)
+	}
+	k, _ = w.Get("server")
+	for _, a := range k.Attachments {
+		var b bytes.Buffer
+		if err := w.ReadAttachment(a, &b); err != nil || !bytes.Equal(b.Bytes(), contents[a.Name]) {
+			t.Errorf("%s: read %d bytes, %v", a.Name, b.Len(), err)
+		}
+	}
+
+	// chunks swapped, and the last chunk dropped
+	large := k.Attachments[2]
+	first, second := filepath.Join(path+".d", "attachments", large.ID, "0"), filepath.Join(path+".d", "attachments", large.ID, "1")
+	c0, _ := ioutil.ReadFile(first)
+	c1, _ := ioutil.ReadFile(second)
+	ioutil.WriteFile(first, c1, 0600)
+	ioutil.WriteFile(second, c0, 0600)
+	if err := w.ReadAttachment(large, ioutil.Discard); err != ErrTampered {
+		t.Errorf("swapped chunks: got %v, want ErrTampered", err)
+	}
+	large.Size = attachmentChunk
+	if err := w.ReadAttachment(large, ioutil.Discard); err != ErrTampered {
+		t.Errorf("truncated: got %v, want ErrTampered", err)
+	}
+
+	// attached by w, while v removes the key and saves first
+	a, err := w.Attach("new", bytes.NewReader([]byte("new")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Attachments = append(k.Attachments, a)
+	w.Put(k)
+
+	if found := v.Delete("server"); !found {
+		t.Fatal("server not deleted")
+	}
+	if n := len(chunks()); n != 6+1 {
+		t.Errorf("%d chunks before save, want 7", n)
+	}
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(chunks()); n != 1 {
+		t.Errorf("%d chunks after the key was removed, want 1", n)
+	}
+
+	if err := w.Save(); err == nil {
+		t.Fatal("saved over a changed vault")
+	}
+	if n := len(chunks()); n != 0 {
+		t.Errorf("%d chunks left after a failed save, want 0", n)
+	}
+	if dirs, _ := filepath.Glob(filepath.Join(path+".d", "attachments", "*")); len(dirs) != 0 {
+		t.Errorf("directories left: %v", dirs)
+	}
+}
+
+func TestRotateAttachments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault")
+	v, err := Create(&FileStore{Path: path}, &KDFParams{KDF: KDFSHA256}, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := v.Attach("file", bytes.NewReader([]byte("content")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Put(Key{Name: "server", Attachments: []Attachment{a}})
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := v.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	k, _ := v.Get("server")
+	r := k.Attachments[0]
+	if r.ID == a.ID || bytes.Equal(r.Key, a.Key) || r.Added != a.Added {
+		t.Errorf("rotated %+v, was %+v", r, a)
+	}
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.ReadAttachment(a, ioutil.Discard); err == nil {
+		t.Error("old attachment still readable")
+	}
+	var b bytes.Buffer
+	if err := v.ReadAttachment(r, &b); err != nil || b.String() != "content" {
+		t.Errorf("read rotated: %q, %v", b.String(), err)
+	}
+}
+
+func TestRestoreAttachments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault")
+	v, err := Create(&FileStore{Path: path, Backups: 2}, &KDFParams{KDF: KDFSHA256}, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attach := func(content string) Attachment {
+		a, err := v.Attach("f.txt", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.Put(Key{Name: "server", Attachments: []Attachment{a}})
+		if err := v.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	attach("first")
+	replaced := attach("second")
+
+	// the newest backup still has the first content
+	backups, _ := Backups(path)
+	content, err := ioutil.ReadFile(backups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, err := OpenStore(&FileStore{Path: path, Backups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Unlock("pw"); err != nil {
+		t.Fatal(err)
+	}
+	if missing, err := w.MissingAttachments(w.store); err != nil || len(missing) != 0 {
+		t.Errorf("missing %v, %v", missing, err)
+	}
+	k, _ := w.Get("server")
+	var b bytes.Buffer
+	if err := w.ReadAttachment(k.Attachments[0], &b); err != nil || b.String() != "first" {
+		t.Errorf("read restored: %q, %v", b.String(), err)
+	}
+
+	// kept until the backups made before it was replaced are rotated out
+	replacedDir := filepath.Join(path+".d", "attachments", replaced.ID)
+	for i := 0; i < 3; i++ {
+		if _, err := os.Stat(replacedDir); err != nil {
+			t.Errorf("save %d: %v", i, err)
+		}
+		if err := w.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(replacedDir); !os.IsNotExist(err) {
+		t.Errorf("replaced attachment kept: %v", err)
+	}
+	b.Reset()
+	if err := w.ReadAttachment(k.Attachments[0], &b); err != nil || b.String() != "first" {
+		t.Errorf("read after saves: %q, %v", b.String(), err)
+	}
+
+	os.RemoveAll(filepath.Join(path+".d", "attachments", k.Attachments[0].ID))
+	if missing, _ := w.MissingAttachments(w.store); len(missing) != 1 || missing[0] != "server/f.txt" {
+		t.Errorf("missing %v", missing)
+	}
+}
+
+func TestCopyAttachment(t *testing.T) {
+	dir := t.TempDir()
+	from, err := Create(NewDirStore(filepath.Join(dir, "from")), &KDFParams{KDF: KDFSHA256}, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := Create(NewFileStore(filepath.Join(dir, "to")), &KDFParams{KDF: KDFSHA256}, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, attachmentChunk+1)
+	crand.Read(content)
+	a, err := from.Attach("file", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := to.CopyAttachment(from, a)
+	if err != nil || c.ID == a.ID || bytes.Equal(c.Key, a.Key) {
+		t.Fatalf("copy: %+v, %v", c, err)
+	}
+	var b bytes.Buffer
+	if err := to.ReadAttachment(c, &b); err != nil || !bytes.Equal(b.Bytes(), content) {
+		t.Errorf("read copy: %d bytes, %v", b.Len(), err)
+	}
+
+	a.Size++
+	if _, err := to.CopyAttachment(from, a); err == nil {
+		t.Error("copied a broken attachment")
+	}
+	if _, err := from.Attach("broken", io.MultiReader(bytes.NewReader(content), iotest.ErrReader(io.ErrClosedPipe))); err == nil {
+		t.Error("attached a failing reader")
+	}
+}
@@ -0,0 +1,149 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// In a store that keeps one object per key, see DirStore, the payload of
+// the vault file has no keys but the ids of their objects, keys/<id>. Each
+// object is the JSON of the key sealed with the data key, its id being the
+// additional data. A changed key goes to a new object before the vault file
+// is replaced and the object it replaces is removed after, so that the vault
+// file only ever points to complete objects.
+
+type storedEntry struct {
+	id   string
+	data []byte // the JSON of the key as stored
+}
+
+func entryObject(id string) string {
+	return "keys/" + id
+}
+
+func sealEntry(dataKey []byte, id string, data []byte) ([]byte, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(crand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, []byte("keybox entry "+id)), nil
+}
+
+func openEntry(dataKey []byte, id string, content []byte) ([]byte, error) {
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	n := gcm.NonceSize()
+	if len(content) < n {
+		return nil, ErrCorrupted
+	}
+	data, err := gcm.Open(nil, content[:n], content[n:], []byte("keybox entry "+id))
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return data, nil
+}
+
+// loadEntries reads the keys listed in p from their objects into p.Keys.
+func (v *Vault) loadEntries(p *payload, dataKey []byte) error {
+	if v.store == nil {
+		return fmt.Errorf("The keys of this vault are kept in its store")
+	}
+
+	stored := make(map[string]storedEntry)
+	for name, id := range p.Entries {
+		content, _, err := v.store.Get(entryObject(id))
+		if err == ErrNotFound {
+			return fmt.Errorf("Key %s is missing from %s", name, v.store)
+		}
+		if err != nil {
+			return err
+		}
+		data, err := openEntry(dataKey, id, content)
+		if err != nil {
+			return err
+		}
+
+		var k Key
+		if err := json.Unmarshal(data, &k); err != nil {
+			return fmt.Errorf("Key %s corrupted: %s", name, err)
+		}
+		// the object of another key
+		if k.Name != name {
+			return ErrTampered
+		}
+		p.Keys[name] = k
+		stored[name] = storedEntry{id, data}
+	}
+
+	v.perEntry, v.stored, v.entriesKey = true, stored, append([]byte(nil), dataKey...)
+	return nil
+}
+
+// saveEntries writes the keys that changed since they were stored, or all
+// of them if the data key changed, to new objects. It returns the ids of all
+// the keys, what is stored once the vault file is saved, and the names of
+// the objects written and of those they replace.
+func (v *Vault) saveEntries(dataKey []byte) (ids map[string]string, stored map[string]storedEntry, written, replaced []string, err error) {
+	rewrap := !hmac.Equal(dataKey, v.entriesKey)
+	ids, stored = make(map[string]string), make(map[string]storedEntry)
+	defer func() {
+		if err != nil {
+			for _, name := range written {
+				v.store.Delete(name)
+			}
+		}
+	}()
+
+	for name, k := range v.keys {
+		data, err := json.Marshal(k)
+		if err != nil {
+			return nil, nil, written, nil, err
+		}
+
+		old, found := v.stored[name]
+		if found && !rewrap && bytes.Equal(old.data, data) {
+			ids[name], stored[name] = old.id, old
+			continue
+		}
+
+		id, err := newEntryID()
+		if err != nil {
+			return nil, nil, written, nil, err
+		}
+		content, err := sealEntry(dataKey, id, data)
+		if err != nil {
+			return nil, nil, written, nil, err
+		}
+		if _, err := v.store.Put(entryObject(id), content, ""); err != nil {
+			return nil, nil, written, nil, err
+		}
+		written = append(written, entryObject(id))
+		ids[name], stored[name] = id, storedEntry{id, data}
+	}
+
+	for name, old := range v.stored {
+		if s, found := stored[name]; !found || s.id != old.id {
+			replaced = append(replaced, entryObject(old.id))
+		}
+	}
+	return ids, stored, written, replaced, nil
+}
+
+func newEntryID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(crand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,316 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Keybox file format v3:
+//
+//	magic       4 bytes  "KBOX"
+//	version     1 byte   FormatV3
+//	kdf         1 byte   kdf identifier
+//	kdf params  2 bytes  big endian length, followed by the kdf parameters
+//	check       16 bytes key check value of the passphrase key
+//	wrapped key 2 bytes  big endian length, followed by the wrapped data key
+//	nonce       12 bytes AES-GCM nonce
+//	ciphertext           AES-GCM sealed JSON payload
+//
+// The payload is encrypted with a random data key, which is itself sealed
+// with the key derived from the passphrase. Changing the passphrase only
+// rewraps the data key. Everything before the ciphertext is authenticated as
+// additional data, so any change to the header is detected as well.
+//
+// v2 files have no wrapped key, their payload is encrypted with the
+// passphrase key directly. They get a data key when they are saved.
+//
+// Files without the magic number are v1 files: a bare IV followed by the
+// AES-CBC encrypted, zero padded payload.
+const (
+	fileMagic = "KBOX"
+	FormatV1  = 1
+	FormatV2  = 2
+	FormatV3  = 3
+
+	keyCheckSize = 16
+	dataKeySize  = 32
+)
+
+// The errors of opening a vault file.
+var (
+	ErrWrongPassword = errors.New("Wrong password")
+	ErrCorrupted     = errors.New("File corrupted")
+	ErrTampered      = errors.New("File corrupted or tampered with")
+	ErrVersion       = errors.New("Unsupported file format version")
+)
+
+type header struct {
+	Version   byte
+	KDF       byte
+	KDFParams []byte
+	Check     []byte
+	Wrapped   []byte // v3 only
+	Nonce     []byte
+
+	// DataKey is the unwrapped data key, it is never written as is.
+	DataKey []byte
+}
+
+func (h *header) marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fileMagic)
+	buf.WriteByte(h.Version)
+	buf.WriteByte(h.KDF)
+	binary.Write(&buf, binary.BigEndian, uint16(len(h.KDFParams)))
+	buf.Write(h.KDFParams)
+	buf.Write(h.Check)
+	if h.Version >= FormatV3 {
+		binary.Write(&buf, binary.BigEndian, uint16(len(h.Wrapped)))
+		buf.Write(h.Wrapped)
+	}
+	buf.Write(h.Nonce)
+	return buf.Bytes()
+}
+
+// fileVersion reports the format version of the file content.
+func fileVersion(content []byte) byte {
+	if len(content) > len(fileMagic) && bytes.HasPrefix(content, []byte(fileMagic)) {
+		return content[len(fileMagic)]
+	}
+	return FormatV1
+}
+
+// parseHeader splits a v2 or v3 file into its header and ciphertext. The length of
+// the header bytes is returned so that they can be used as additional data.
+func parseHeader(content []byte) (h *header, n int, err error) {
+	r := bytes.NewReader(content)
+	magic := make([]byte, len(fileMagic))
+	if _, err = io.ReadFull(r, magic); err != nil || string(magic) != fileMagic {
+		return nil, 0, ErrCorrupted
+	}
+
+	h = &header{}
+	if h.Version, err = r.ReadByte(); err != nil {
+		return nil, 0, ErrCorrupted
+	}
+	if h.Version != FormatV2 && h.Version != FormatV3 {
+		return nil, 0, ErrVersion
+	}
+
+	if h.KDF, err = r.ReadByte(); err != nil {
+		return nil, 0, ErrCorrupted
+	}
+
+	var l uint16
+	if err = binary.Read(r, binary.BigEndian, &l); err != nil {
+		return nil, 0, ErrCorrupted
+	}
+
+	h.KDFParams = make([]byte, l)
+	h.Check = make([]byte, keyCheckSize)
+	for _, b := range [][]byte{h.KDFParams, h.Check} {
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, 0, ErrCorrupted
+		}
+	}
+
+	if h.Version >= FormatV3 {
+		if err = binary.Read(r, binary.BigEndian, &l); err != nil {
+			return nil, 0, ErrCorrupted
+		}
+		h.Wrapped = make([]byte, l)
+		if _, err = io.ReadFull(r, h.Wrapped); err != nil {
+			return nil, 0, ErrCorrupted
+		}
+	}
+
+	h.Nonce = make([]byte, 12)
+	if _, err = io.ReadFull(r, h.Nonce); err != nil {
+		return nil, 0, ErrCorrupted
+	}
+
+	return h, len(content) - r.Len(), nil
+}
+
+// keyCheck derives a value from the key that tells a wrong password apart
+// from a tampered file. It needs the key just like the GCM tag does, so it
+// gives nothing away that the ciphertext does not.
+func keyCheck(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("keybox key check"))
+	return mac.Sum(nil)[:keyCheckSize]
+}
+
+// sealFile wraps the data key of h with key and encrypts the payload with
+// the data key and a fresh nonce. A data key is generated if h has none.
+// It returns the whole file.
+//
+// For a team vault key is the data key itself, the caller wraps it for the
+// members in h.Wrapped beforehand.
+func sealFile(h *header, payload, key []byte) ([]byte, error) {
+	wrapped := h.Wrapped
+	if h.KDF == KDFAge {
+		h.DataKey = key
+	} else {
+		if h.DataKey == nil {
+			h.DataKey = make([]byte, dataKeySize)
+			if _, err := io.ReadFull(crand.Reader, h.DataKey); err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		if wrapped, err = wrapKey(h.DataKey, key); err != nil {
+			return nil, err
+		}
+	}
+
+	gcm, err := newGCM(h.DataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	h.Version = FormatV3
+	h.Check = keyCheck(key)
+	h.Wrapped = wrapped
+	h.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(crand.Reader, h.Nonce); err != nil {
+		return nil, err
+	}
+
+	ad := h.marshal()
+	return gcm.Seal(ad, h.Nonce, payload, ad), nil
+}
+
+// openFile authenticates and decrypts a v2 or v3 file with the passphrase
+// key, or with the data key for a team vault. The data key of a v3 file is
+// left in the returned header.
+func openFile(content, key []byte) (*header, []byte, error) {
+	h, n, err := parseHeader(content)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !hmac.Equal(h.Check, keyCheck(key)) {
+		return h, nil, ErrWrongPassword
+	}
+
+	dataKey := key
+	if h.KDF == KDFAge {
+		h.DataKey = dataKey
+	} else if h.Version >= FormatV3 {
+		if dataKey, err = unwrapKey(h.Wrapped, key); err != nil {
+			return h, nil, ErrTampered
+		}
+		h.DataKey = dataKey
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return h, nil, err
+	}
+
+	payload, err := gcm.Open(nil, h.Nonce, content[n:], content[:n])
+	if err != nil {
+		return h, nil, ErrTampered
+	}
+
+	return h, payload, nil
+}
+
+// wrapKey seals the data key with key, the nonce goes first.
+func wrapKey(dataKey, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(crand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, dataKey, []byte("keybox data key")), nil
+}
+
+func unwrapKey(wrapped, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, ErrCorrupted
+	}
+
+	n := gcm.NonceSize()
+	return gcm.Open(nil, wrapped[:n], wrapped[n:], []byte("keybox data key"))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt and decrypt implement the legacy v1 AES-CBC format.
+func encrypt(plaintext, key, iv []byte) (ciphertext []byte, err error) {
+	// CBC mode works on blocks so plaintexts may need to be padded to the
+	// next whole block. For an example of such padding, see
+	// https://tools.ietf.org/html/rfc5246#section-6.2.3.2.
+	for i := len(plaintext) % aes.BlockSize; i < aes.BlockSize; i++ {
+		plaintext = append(plaintext, byte(0))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+
+	ciphertext = make([]byte, len(plaintext))
+	mode := cipher.NewCBCEncrypter(block, iv)
+	mode.CryptBlocks(ciphertext, plaintext)
+
+	// It's important to remember that ciphertexts must be authenticated
+	// (i.e. by using crypto/hmac) as well as being encrypted in order to
+	// be secure.
+
+	return
+}
+
+func decrypt(ciphertext, key, iv []byte) (plaintext []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+
+	// CBC mode always works in whole blocks.
+	if len(ciphertext)%aes.BlockSize != 0 {
+		err = errors.New("ciphertext is not a multiple of the block size")
+		return
+	}
+
+	mode := cipher.NewCBCDecrypter(block, iv)
+
+	// CryptBlocks can work in-place if the two arguments are the same.
+	plaintext = make([]byte, len(ciphertext))
+	mode.CryptBlocks(plaintext, ciphertext)
+
+	i := len(plaintext) - 1
+	for ; i > 0 && plaintext[i-1] == 0; i-- {
+	}
+
+	plaintext = plaintext[:i]
+	//However, it's critical to note that ciphertexts must be authenticated (i.e. by
+	// using crypto/hmac) before being decrypted in order to avoid creating
+	// a padding oracle.
+
+	return
+}
@@ -0,0 +1,140 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/aes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"io"
+	"testing"
+)
+
+func TestSealOpenFile(t *testing.T) {
+	key := sha256.Sum256([]byte("my secretes"))
+	original := `{"example":{"Name":"example"}}`
+
+	content, err := sealFile(&header{KDF: KDFSHA256}, []byte(original), key[:])
+	if err != nil {
+		t.Fatalf("Seal error: %s", err)
+	}
+
+	if v := fileVersion(content); v != FormatV3 {
+		t.Errorf("file version %d != %d", v, FormatV3)
+	}
+
+	_, payload, err := openFile(content, key[:])
+	if err != nil {
+		t.Fatalf("Open error: %s", err)
+	}
+	if string(payload) != original {
+		t.Errorf("\"%s\" != \"%s\"", payload, original)
+	}
+
+	wrong := sha256.Sum256([]byte("not my secretes"))
+	if _, _, err := openFile(content, wrong[:]); err != ErrWrongPassword {
+		t.Errorf("wrong key: got %v, want %v", err, ErrWrongPassword)
+	}
+
+	// flip a bit in the header and in the ciphertext
+	for _, i := range []int{len(fileMagic) + 1, len(content) - 1} {
+		tampered := append([]byte(nil), content...)
+		tampered[i] ^= 1
+		if _, _, err := openFile(tampered, key[:]); err != ErrTampered {
+			t.Errorf("tampered byte %d: got %v, want %v", i, err, ErrTampered)
+		}
+	}
+}
+
+func TestFileVersionV1(t *testing.T) {
+	if v := fileVersion(make([]byte, 32)); v != FormatV1 {
+		t.Errorf("file version %d != %d", v, FormatV1)
+	}
+}
+
+func TestRewrapDataKey(t *testing.T) {
+	oldKey := sha256.Sum256([]byte("old"))
+	newKey := sha256.Sum256([]byte("new"))
+	original := `{"Schema":4}`
+
+	h := &header{KDF: KDFSHA256}
+	content, err := sealFile(h, []byte(original), oldKey[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _, err = openFile(content, oldKey[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey := h.DataKey
+
+	// a passphrase change keeps the data key
+	if content, err = sealFile(h, []byte(original), newKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := openFile(content, oldKey[:]); err != ErrWrongPassword {
+		t.Errorf("old key: got %v, want %v", err, ErrWrongPassword)
+	}
+	h, payload, err := openFile(content, newKey[:])
+	if err != nil || string(payload) != original {
+		t.Fatalf("new key: %q, %v", payload, err)
+	}
+	if !bytes.Equal(h.DataKey, dataKey) {
+		t.Error("data key changed with the passphrase")
+	}
+
+	// a rotation replaces it
+	h.DataKey = nil
+	if content, err = sealFile(h, []byte(original), newKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	if h, _, err = openFile(content, newKey[:]); err != nil || bytes.Equal(h.DataKey, dataKey) {
+		t.Errorf("rotated data key: %v", err)
+	}
+}
+
+func TestOpenFileV2(t *testing.T) {
+	key := sha256.Sum256([]byte("my secretes"))
+	original := `{"Schema":4}`
+
+	gcm, err := newGCM(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &header{Version: FormatV2, KDF: KDFSHA256, Check: keyCheck(key[:]), Nonce: make([]byte, gcm.NonceSize())}
+	ad := h.marshal()
+	content := gcm.Seal(ad, h.Nonce, []byte(original), ad)
+
+	h, payload, err := openFile(content, key[:])
+	if err != nil || string(payload) != original {
+		t.Fatalf("v2 file: %q, %v", payload, err)
+	}
+	if h.DataKey != nil {
+		t.Error("v2 file has a data key")
+	}
+}
+
+func TestEncryptDescrypt(t *testing.T) {
+	h := sha256.New()
+	h.Write([]byte("my secretes"))
+	key := h.Sum(nil)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(crand.Reader, iv); err != nil {
+		t.Errorf("iv initialization error: %s", err)
+	}
+
+	original := "hello world!"
+	ciphertext, err := encrypt([]byte(original), key, iv)
+	if err != nil {
+		t.Errorf("Encrytpion error: %s", err)
+	}
+
+	decrypted, err := decrypt(ciphertext, key, iv)
+	if err != nil {
+		t.Errorf("Decrypt error: %s", err)
+	}
+
+	if string(decrypted) != original {
+		t.Errorf("%d %d", len(string(decrypted)), len(original))
+		t.Errorf("\"%s\" != \"%s\"", string(decrypted), original)
+	}
+}
@@ -0,0 +1,155 @@
+package vault
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The key derivation functions, as identified in the file header.
+const (
+	KDFSHA256   = 0 // unsalted sha256 of the passphrase, as used by v1
+	KDFArgon2id = 1
+	KDFScrypt   = 2
+	KDFAge      = 3 // team vault, see team.go: no passphrase at all
+
+	saltSize = 16
+
+	// the upper bounds of the costs, far above the defaults, against headers
+	// crafted to keep Unlock busy
+	maxArgon2Time = 64
+	maxKDFThreads = 64
+)
+
+// KDFNames are the key derivation functions by name.
+var KDFNames = map[string]byte{
+	"sha256":   KDFSHA256,
+	"argon2id": KDFArgon2id,
+	"scrypt":   KDFScrypt,
+}
+
+// KDFParams are the passphrase derivation parameters stored in the file
+// header. The cost fields are interpreted per kdf:
+//
+//	argon2id  Time = iterations, Memory = KiB, Threads = parallelism
+//	scrypt    Time = log2(N),    Memory = r,   Threads = p
+type KDFParams struct {
+	KDF     byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	Salt    []byte
+}
+
+// NewKDFParams returns the default cost for kdf with a fresh random salt.
+func NewKDFParams(kdf byte) (*KDFParams, error) {
+	var p *KDFParams
+	switch kdf {
+	case KDFArgon2id:
+		p = &KDFParams{KDF: kdf, Time: 3, Memory: 64 * 1024, Threads: 4}
+	case KDFScrypt:
+		p = &KDFParams{KDF: kdf, Time: 15, Memory: 8, Threads: 1}
+	default:
+		return nil, fmt.Errorf("Unsupported kdf %d", kdf)
+	}
+
+	p.Salt = make([]byte, saltSize)
+	if _, err := io.ReadFull(crand.Reader, p.Salt); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *KDFParams) marshal() []byte {
+	if p.KDF == KDFSHA256 || p.KDF == KDFAge {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, p.Time)
+	binary.Write(&buf, binary.BigEndian, p.Memory)
+	buf.WriteByte(p.Threads)
+	buf.Write(p.Salt)
+	return buf.Bytes()
+}
+
+func parseKDFParams(kdf byte, b []byte) (*KDFParams, error) {
+	p := &KDFParams{KDF: kdf}
+	if kdf == KDFSHA256 || kdf == KDFAge {
+		return p, nil
+	}
+
+	if len(b) < 9 {
+		return nil, ErrCorrupted
+	}
+	p.Time = binary.BigEndian.Uint32(b[0:4])
+	p.Memory = binary.BigEndian.Uint32(b[4:8])
+	p.Threads = b[8]
+	p.Salt = b[9:]
+
+	return p, p.Validate()
+}
+
+// Validate rejects parameters that cannot be used or that would make a
+// crafted header exhaust the memory of the machine.
+func (p *KDFParams) Validate() error {
+	switch p.KDF {
+	case KDFSHA256, KDFAge:
+		return nil
+	case KDFArgon2id:
+		if p.Time < 1 || p.Time > maxArgon2Time || p.Threads < 1 || p.Threads > maxKDFThreads ||
+			p.Memory < 8*uint32(p.Threads) || p.Memory > 4*1024*1024 {
+			return errors.New("Invalid argon2id parameters")
+		}
+	case KDFScrypt:
+		if p.Time < 1 || p.Time > 24 || p.Memory < 1 || p.Threads < 1 || p.Threads > maxKDFThreads ||
+			uint64(p.Memory)*uint64(p.Threads) >= 1<<30 || 128*uint64(p.Memory)<<p.Time > 4<<30 {
+			return errors.New("Invalid scrypt parameters")
+		}
+	default:
+		return fmt.Errorf("Unsupported kdf %d", p.KDF)
+	}
+
+	if len(p.Salt) < saltSize {
+		return errors.New("Salt is too short")
+	}
+	return nil
+}
+
+func (p *KDFParams) String() string {
+	switch p.KDF {
+	case KDFArgon2id:
+		return fmt.Sprintf("argon2id time=%d memory=%dKiB threads=%d", p.Time, p.Memory, p.Threads)
+	case KDFScrypt:
+		return fmt.Sprintf("scrypt N=2^%d r=%d p=%d", p.Time, p.Memory, p.Threads)
+	case KDFAge:
+		return "none, team vault opened with age identities"
+	}
+	return "sha256 (unsalted)"
+}
+
+// DeriveKey converts a passphrase to a 256 bit key.
+func DeriveKey(passphrase string, p *KDFParams) ([]byte, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch p.KDF {
+	case KDFArgon2id:
+		return argon2.IDKey([]byte(passphrase), p.Salt, p.Time, p.Memory, p.Threads, 32), nil
+	case KDFScrypt:
+		return scrypt.Key([]byte(passphrase), p.Salt, 1<<p.Time, int(p.Memory), int(p.Threads), 32)
+	case KDFAge:
+		return nil, errors.New("Team vaults have no passphrase")
+	}
+
+	h := sha256.Sum256([]byte(passphrase))
+	return h[:], nil
+}
@@ -0,0 +1,66 @@
+package vault
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	for _, id := range []byte{KDFArgon2id, KDFScrypt} {
+		p, err := NewKDFParams(id)
+		if err != nil {
+			t.Fatalf("kdf %d: %s", id, err)
+		}
+		// keep the test fast
+		p.Time, p.Memory = 1, 64
+		if id == KDFScrypt {
+			p.Time, p.Memory = 10, 8
+		}
+
+		k1, err := DeriveKey("my secretes", p)
+		if err != nil {
+			t.Fatalf("%s: %s", p, err)
+		}
+		if len(k1) != 32 {
+			t.Errorf("%s: key length %d", p, len(k1))
+		}
+
+		parsed, err := parseKDFParams(p.KDF, p.marshal())
+		if err != nil {
+			t.Fatalf("%s: parse error: %s", p, err)
+		}
+		if k2, _ := DeriveKey("my secretes", parsed); !bytes.Equal(k1, k2) {
+			t.Errorf("%s: key differs after marshal/parse", p)
+		}
+
+		q, _ := NewKDFParams(id)
+		q.Time, q.Memory = p.Time, p.Memory
+		if k3, _ := DeriveKey("my secretes", q); bytes.Equal(k1, k3) {
+			t.Errorf("%s: same key with a different salt", p)
+		}
+	}
+}
+
+func TestKDFParamsValidate(t *testing.T) {
+	salt := make([]byte, saltSize)
+	for _, p := range []*KDFParams{
+		{KDF: KDFArgon2id, Time: 1, Memory: 1 << 30, Threads: 1, Salt: salt},
+		{KDF: KDFArgon2id, Time: 0, Memory: 1024, Threads: 1, Salt: salt},
+		{KDF: KDFArgon2id, Time: 1, Memory: 1024, Threads: 1, Salt: salt[:4]},
+		{KDF: KDFArgon2id, Time: maxArgon2Time + 1, Memory: 1024, Threads: 1, Salt: salt},
+		{KDF: KDFArgon2id, Time: 1, Memory: 4096, Threads: maxKDFThreads + 1, Salt: salt},
+		{KDF: KDFScrypt, Time: 30, Memory: 8, Threads: 1, Salt: salt},
+		{KDF: KDFScrypt, Time: 15, Memory: 8, Threads: maxKDFThreads + 1, Salt: salt},
+		{KDF: 42, Salt: salt},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", p)
+		}
+	}
+
+	// as read from a crafted header
+	p := &KDFParams{KDF: KDFArgon2id, Time: 1 << 31, Memory: 1024, Threads: 1, Salt: salt}
+	if _, err := parseKDFParams(p.KDF, p.marshal()); err == nil {
+		t.Errorf("header with time %d accepted", p.Time)
+	}
+}
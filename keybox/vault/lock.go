@@ -0,0 +1,49 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Processes that modify a vault take an exclusive advisory lock on
+// path.lock before opening it and hold it until they are done. The lock
+// file holds the pid of the owner so that the others can tell who it is. It
+// is never removed, removing it would let two processes lock different
+// files.
+//
+// On top of that Save refuses to overwrite a file that changed since it was
+// opened, which catches processes that do not take the lock.
+
+// ErrLocked is returned by Lock when another process holds the lock.
+var ErrLocked = errors.New("locked")
+
+// Lock takes the lock of the vault file at path without waiting for it.
+// Closing the returned lock releases it.
+func Lock(path string) (io.Closer, error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open lock file: %s", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return f, nil
+}
+
+// LockOwner describes the process holding the lock of the vault at path.
+func LockOwner(path string) string {
+	content, err := ioutil.ReadFile(path + ".lock")
+	if pid := strings.TrimSpace(string(content)); err == nil && len(pid) > 0 {
+		return "pid " + pid
+	}
+	return "another process"
+}
@@ -0,0 +1,25 @@
+package vault
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault")
+	first, err := Lock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lock(path); err != ErrLocked {
+		t.Fatalf("second lock: got %v, want ErrLocked", err)
+	}
+
+	// closing the file releases the lock, as exiting does
+	first.Close()
+	second, err := Lock(path)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	second.Close()
+}
@@ -0,0 +1,201 @@
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Two copies of a vault changed independently, e.g. on two machines, are
+// merged key by key: a key changed on one side only takes that change, a key
+// changed on both sides takes the newer one. Deleted keys leave a tombstone
+// with the time of deletion, so that they are not brought back by a copy
+// that still has them.
+
+// Merge merges theirs into v, both being changed copies of base, which is
+// nil if they have nothing in common. All three must be unlocked. The names
+// of the keys changed on both sides are returned.
+//
+// A passphrase or data key changed on their side only is taken over, and
+// the data key of a team vault is replaced if the merge removes a member.
+func (v *Vault) Merge(base, theirs *Vault) ([]string, error) {
+	if !v.unlocked || !theirs.unlocked || base != nil && !base.unlocked {
+		return nil, ErrNotUnlocked
+	}
+
+	b := &payload{Keys: make(map[string]Key)}
+	if base != nil {
+		b = base.payload()
+	}
+	m, conflicts := mergeVersions(b, v.payload(), theirs.payload())
+
+	if base != nil && !bytes.Equal(theirs.hdr.Check, base.hdr.Check) && bytes.Equal(v.hdr.Check, base.hdr.Check) {
+		v.kdf, v.key = theirs.kdf, append([]byte(nil), theirs.key...)
+		v.hdr.DataKey = append([]byte(nil), theirs.hdr.DataKey...)
+	}
+	removed := v.Team() && !containsMembers(m.Members, v.members)
+	v.setPayload(m)
+	// whoever was removed on their side may know the current data key
+	if removed {
+		if err := v.RotateKey(); err != nil {
+			return nil, err
+		}
+	}
+	return conflicts, nil
+}
+
+// mergeVersions merges the keys, tombstones, log and members of ours and
+// theirs, which both derive from base. The names of the keys changed on both
+// sides are returned. The password of the losing side of such a conflict is
+// kept in the history of the winner.
+func mergeVersions(base, ours, theirs *payload) (*payload, []string) {
+	m := &payload{Schema: schemaVersion, Keys: make(map[string]Key), Deleted: make(map[string]time.Time)}
+
+	seen := make(map[string]bool)
+	for _, p := range []*payload{ours, theirs} {
+		for name := range p.Keys {
+			seen[name] = true
+		}
+		for name := range p.Deleted {
+			seen[name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var conflicts []string
+	for _, name := range names {
+		b, _ := entry(base, name)
+		o, oTime := entry(ours, name)
+		t, tTime := entry(theirs, name)
+
+		pick, pickTime := o, oTime
+		switch {
+		case sameKey(o, t):
+			if tTime.After(oTime) {
+				pickTime = tTime
+			}
+		case sameKey(b, o):
+			pick, pickTime = t, tTime
+		case sameKey(b, t):
+		default:
+			conflicts = append(conflicts, name)
+			if tTime.After(oTime) {
+				pick, pickTime = t, tTime
+				keepPassword(pick, o)
+			} else {
+				keepPassword(pick, t)
+			}
+		}
+
+		if pick != nil {
+			m.Keys[name] = *pick
+		} else if !pickTime.IsZero() {
+			m.Deleted[name] = pickTime
+		}
+	}
+
+	m.Log = mergeLogs(ours.Log, theirs.Log)
+	m.Members = mergeMembers(base.Members, ours.Members, theirs.Members)
+	return m, conflicts
+}
+
+// entry returns the key name of p and when it was changed, or nil and when
+// it was deleted.
+func entry(p *payload, name string) (*Key, time.Time) {
+	if k, found := p.Keys[name]; found {
+		return &k, k.Modified
+	}
+	return nil, p.Deleted[name]
+}
+
+func sameKey(a, b *Key) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+// keepPassword adds the password of loser to the history of winner.
+func keepPassword(winner, loser *Key) {
+	if winner == nil || loser == nil || winner.Password == loser.Password {
+		return
+	}
+	for _, c := range winner.History {
+		if c.Password == loser.Password {
+			return
+		}
+	}
+	winner.History = append(append([]PasswordChange(nil), winner.History...), PasswordChange{loser.Password, loser.Modified})
+	sort.SliceStable(winner.History, func(i, j int) bool { return winner.History[i].Changed.Before(winner.History[j].Changed) })
+}
+
+// mergeLogs returns the records of both logs once, in time order.
+func mergeLogs(ours, theirs []LogRecord) []LogRecord {
+	id := func(r LogRecord) string { return fmt.Sprint(r.Time.UnixNano(), r.Op, r.Name) }
+
+	seen := make(map[string]bool)
+	merged := append([]LogRecord(nil), ours...)
+	for _, r := range ours {
+		seen[id(r)] = true
+	}
+	for _, r := range theirs {
+		if !seen[id(r)] {
+			merged = append(merged, r)
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Time.Before(merged[j].Time) })
+	return merged
+}
+
+// mergeMembers merges the member lists by name, ours wins a conflict.
+func mergeMembers(base, ours, theirs []Member) []Member {
+	find := func(ms []Member, name string) *Member {
+		for i := range ms {
+			if ms[i].Name == name {
+				return &ms[i]
+			}
+		}
+		return nil
+	}
+	same := func(a, b *Member) bool {
+		return a == nil && b == nil || a != nil && b != nil && a.Recipient == b.Recipient
+	}
+
+	var merged []Member
+	for _, m := range append(append([]Member(nil), ours...), theirs...) {
+		if find(merged, m.Name) != nil {
+			continue
+		}
+		b, o, t := find(base, m.Name), find(ours, m.Name), find(theirs, m.Name)
+		pick := o
+		if !same(o, t) && same(b, o) {
+			pick = t
+		}
+		if pick != nil {
+			merged = append(merged, *pick)
+		}
+	}
+	return merged
+}
+
+// containsMembers reports whether every recipient of sub is in ms.
+func containsMembers(ms, sub []Member) bool {
+	for _, s := range sub {
+		found := false
+		for _, m := range ms {
+			found = found || m.Recipient == s.Recipient
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
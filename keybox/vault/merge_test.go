@@ -0,0 +1,86 @@
+package vault
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeVersions(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(h int) time.Time { return t0.Add(time.Duration(h) * time.Hour) }
+	k := func(name, password string, h int) Key {
+		return Key{Name: name, Password: password, Created: t0, Modified: at(h)}
+	}
+
+	base := &payload{Keys: map[string]Key{
+		"same":      k("same", "a", 0),
+		"ours":      k("ours", "a", 0),
+		"theirs":    k("theirs", "a", 0),
+		"both":      k("both", "a", 0),
+		"deleted":   k("deleted", "a", 0),
+		"edited":    k("edited", "a", 0),
+		"undeleted": k("undeleted", "a", 0),
+	}}
+	ours := &payload{
+		Keys: map[string]Key{
+			"same":      k("same", "a", 0),
+			"ours":      k("ours", "b", 1),
+			"theirs":    k("theirs", "a", 0),
+			"both":      k("both", "b", 1),
+			"edited":    k("edited", "a", 0),
+			"undeleted": k("undeleted", "b", 3),
+			"new":       k("new", "n", 1),
+		},
+		Deleted: map[string]time.Time{"deleted": at(1)},
+		Log:     []LogRecord{{at(1), "update", "ours"}},
+	}
+	theirs := &payload{
+		Keys: map[string]Key{
+			"same":    k("same", "a", 0),
+			"ours":    k("ours", "a", 0),
+			"theirs":  k("theirs", "c", 2),
+			"both":    k("both", "c", 2),
+			"deleted": k("deleted", "a", 0),
+			"edited":  k("edited", "c", 2),
+		},
+		Deleted: map[string]time.Time{"undeleted": at(2)},
+		Log:     []LogRecord{{at(2), "update", "theirs"}},
+	}
+
+	m, conflicts := mergeVersions(base, ours, theirs)
+
+	want := map[string]string{"same": "a", "ours": "b", "theirs": "c", "both": "c", "edited": "c", "undeleted": "b", "new": "n"}
+	got := make(map[string]string)
+	for name, k := range m.Keys {
+		got[name] = k.Password
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merged passwords %v, want %v", got, want)
+	}
+	if !m.Deleted["deleted"].Equal(at(1)) || len(m.Deleted) != 1 {
+		t.Errorf("tombstones %v", m.Deleted)
+	}
+	if !reflect.DeepEqual(conflicts, []string{"both", "undeleted"}) {
+		t.Errorf("conflicts %v", conflicts)
+	}
+	if h := m.Keys["both"].History; len(h) != 1 || h[0].Password != "b" {
+		t.Errorf("history of both %v", h)
+	}
+	if len(m.Log) != 2 || m.Log[0].Name != "ours" {
+		t.Errorf("log %v", m.Log)
+	}
+}
+
+func TestMergeMembers(t *testing.T) {
+	a, b, c := Member{Name: "a", Recipient: "ra"}, Member{Name: "b", Recipient: "rb"}, Member{Name: "c", Recipient: "rc"}
+
+	// b is removed on our side, c is added on theirs
+	merged := mergeMembers([]Member{a, b}, []Member{a}, []Member{a, b, c})
+	if !reflect.DeepEqual(merged, []Member{a, c}) {
+		t.Errorf("merged %v", merged)
+	}
+	if containsMembers(merged, []Member{a, b}) || !containsMembers(merged, []Member{c}) {
+		t.Error("containsMembers")
+	}
+}
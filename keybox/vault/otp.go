@@ -0,0 +1,184 @@
+package vault
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTP is an RFC 6238 TOTP or RFC 4226 HOTP secret, as found in
+// otpauth:// URIs.
+type OTP struct {
+	Type      string // totp or hotp
+	Secret    string // base32
+	Algorithm string // SHA1, SHA256 or SHA512
+	Digits    int
+	Period    int    `json:",omitempty"` // totp only, in seconds
+	Counter   uint64 `json:",omitempty"` // hotp only
+	Issuer    string `json:",omitempty"`
+	Account   string `json:",omitempty"`
+}
+
+var otpAlgorithms = map[string]func() hash.Hash{
+	"SHA1":   sha1.New,
+	"SHA256": sha256.New,
+	"SHA512": sha512.New,
+}
+
+// ParseOTPURI parses otpauth://TYPE/LABEL?PARAMETERS as described in
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func ParseOTPURI(s string) (*OTP, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "otpauth" {
+		return nil, fmt.Errorf("Not an otpauth URI: %s", u.Scheme)
+	}
+
+	q := u.Query()
+	o := &OTP{
+		Type:      strings.ToLower(u.Host),
+		Secret:    q.Get("secret"),
+		Algorithm: "SHA1",
+		Digits:    6,
+		Issuer:    q.Get("issuer"),
+	}
+
+	label := strings.TrimPrefix(u.Path, "/")
+	if issuer, account, found := strings.Cut(label, ":"); found {
+		if len(o.Issuer) == 0 {
+			o.Issuer = issuer
+		}
+		o.Account = strings.TrimSpace(account)
+	} else {
+		o.Account = label
+	}
+
+	if a := q.Get("algorithm"); len(a) > 0 {
+		o.Algorithm = strings.ToUpper(a)
+	}
+	if d := q.Get("digits"); len(d) > 0 {
+		if o.Digits, err = strconv.Atoi(d); err != nil {
+			return nil, fmt.Errorf("Invalid digits %s", d)
+		}
+	}
+
+	switch o.Type {
+	case "totp":
+		o.Period = 30
+		if p := q.Get("period"); len(p) > 0 {
+			if o.Period, err = strconv.Atoi(p); err != nil {
+				return nil, fmt.Errorf("Invalid period %s", p)
+			}
+		}
+	case "hotp":
+		c := q.Get("counter")
+		if len(c) == 0 {
+			return nil, errors.New("hotp URI without counter")
+		}
+		if o.Counter, err = strconv.ParseUint(c, 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid counter %s", c)
+		}
+	}
+
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Validate checks the parameters and the secret.
+func (o *OTP) Validate() error {
+	if o.Type != "totp" && o.Type != "hotp" {
+		return fmt.Errorf("Unsupported OTP type %s", o.Type)
+	}
+	if _, found := otpAlgorithms[o.Algorithm]; !found {
+		return fmt.Errorf("Unsupported OTP algorithm %s", o.Algorithm)
+	}
+	if o.Digits < 6 || o.Digits > 10 {
+		return fmt.Errorf("Invalid number of digits %d", o.Digits)
+	}
+	if o.Type == "totp" && o.Period < 1 {
+		return fmt.Errorf("Invalid period %d", o.Period)
+	}
+	_, err := o.key()
+	return err
+}
+
+// key decodes the base32 secret, which is often written in lowercase,
+// without padding or in groups separated by spaces.
+func (o *OTP) key() ([]byte, error) {
+	s := strings.ToUpper(strings.ReplaceAll(o.Secret, " ", ""))
+	k, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(k) == 0 {
+		return nil, errors.New("Invalid OTP secret")
+	}
+	return k, nil
+}
+
+// hotp computes the RFC 4226 code for counter.
+func hotp(k []byte, counter uint64, algorithm string, digits int) string {
+	mac := hmac.New(otpAlgorithms[algorithm], k)
+	binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0xf
+	code := uint64(binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff)
+
+	mod := uint64(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, code%mod)
+}
+
+// Code returns the code at time t and, for TOTP, how long it stays valid.
+func (o *OTP) Code(t time.Time) (string, time.Duration, error) {
+	k, err := o.key()
+	if err != nil {
+		return "", 0, err
+	}
+
+	if o.Type == "hotp" {
+		return hotp(k, o.Counter, o.Algorithm, o.Digits), 0, nil
+	}
+
+	period := int64(o.Period)
+	unix := t.Unix()
+	remaining := time.Duration(period-unix%period) * time.Second
+	return hotp(k, uint64(unix/period), o.Algorithm, o.Digits), remaining, nil
+}
+
+// URI formats the secret as an otpauth:// URI.
+func (o *OTP) URI() string {
+	q := url.Values{}
+	q.Set("secret", o.Secret)
+	q.Set("algorithm", o.Algorithm)
+	q.Set("digits", strconv.Itoa(o.Digits))
+	if o.Type == "hotp" {
+		q.Set("counter", strconv.FormatUint(o.Counter, 10))
+	} else {
+		q.Set("period", strconv.Itoa(o.Period))
+	}
+
+	label := o.Account
+	if len(o.Issuer) > 0 {
+		q.Set("issuer", o.Issuer)
+		label = o.Issuer + ":" + o.Account
+	}
+
+	u := url.URL{Scheme: "otpauth", Host: o.Type, Path: "/" + label, RawQuery: q.Encode()}
+	return u.String()
+}
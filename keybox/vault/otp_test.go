@@ -0,0 +1,83 @@
+package vault
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// test vectors from RFC 6238 appendix B
+func TestTOTP(t *testing.T) {
+	seeds := map[string]string{
+		"SHA1":   "12345678901234567890",
+		"SHA256": "12345678901234567890123456789012",
+		"SHA512": "1234567890123456789012345678901234567890123456789012345678901234",
+	}
+	for _, v := range []struct {
+		unix      int64
+		algorithm string
+		code      string
+	}{
+		{59, "SHA1", "94287082"},
+		{59, "SHA256", "46119246"},
+		{59, "SHA512", "90693936"},
+		{1111111109, "SHA1", "07081804"},
+		{1234567890, "SHA256", "91819424"},
+		{2000000000, "SHA512", "38618901"},
+		{20000000000, "SHA1", "65353130"},
+	} {
+		o := &OTP{
+			Type:      "totp",
+			Secret:    base32.StdEncoding.EncodeToString([]byte(seeds[v.algorithm])),
+			Algorithm: v.algorithm,
+			Digits:    8,
+			Period:    30,
+		}
+		code, valid, err := o.Code(time.Unix(v.unix, 0))
+		if err != nil || code != v.code {
+			t.Errorf("%s at %d: got %s, %v; want %s", v.algorithm, v.unix, code, err, v.code)
+		}
+		if want := time.Duration(30-v.unix%30) * time.Second; valid != want {
+			t.Errorf("%s at %d: valid for %s, want %s", v.algorithm, v.unix, valid, want)
+		}
+	}
+}
+
+// test vectors from RFC 4226 appendix D
+func TestHOTP(t *testing.T) {
+	for counter, want := range []string{"755224", "287082", "359152", "969429", "338314"} {
+		if code := hotp([]byte("12345678901234567890"), uint64(counter), "SHA1", 6); code != want {
+			t.Errorf("counter %d: got %s, want %s", counter, code, want)
+		}
+	}
+}
+
+func TestParseOTPURI(t *testing.T) {
+	o, err := ParseOTPURI("otpauth://totp/ACME%20Co:john@example.com?secret=hxdmvjecjjwsrb3hwizr4ifugftmxboz&algorithm=SHA256&digits=8&period=60")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := OTP{Type: "totp", Secret: "hxdmvjecjjwsrb3hwizr4ifugftmxboz", Algorithm: "SHA256", Digits: 8, Period: 60, Issuer: "ACME Co", Account: "john@example.com"}
+	if *o != want {
+		t.Errorf("got %+v, want %+v", *o, want)
+	}
+
+	for _, s := range []string{
+		"https://example.com",
+		"otpauth://hotp/x?secret=JBSWY3DPEHPK3PXP",
+		"otpauth://totp/x?secret=not-base32",
+		"otpauth://totp/x?secret=JBSWY3DPEHPK3PXP&algorithm=MD5",
+	} {
+		if o, err := ParseOTPURI(s); err == nil || o != nil {
+			t.Errorf("%s: got %+v, expected an error", s, o)
+		}
+	}
+}
+
+func TestOTPURIRoundTrip(t *testing.T) {
+	o := &OTP{Type: "totp", Secret: "JBSWY3DPEHPK3PXP", Algorithm: "SHA256", Digits: 8, Period: 60, Issuer: "ACME Co", Account: "me"}
+	parsed, err := ParseOTPURI(o.URI())
+	if err != nil || *parsed != *o {
+		t.Errorf("%s: got %+v, %v", o.URI(), parsed, err)
+	}
+}
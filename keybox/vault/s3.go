@@ -0,0 +1,88 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// S3Store keeps the objects of a vault in a bucket of an S3-compatible
+// object store, under a prefix. The version of an object is its ETag and
+// writes are conditional on it with If-Match and If-None-Match, which the
+// store has to support.
+type S3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Store returns the store of the vault under prefix in bucket, at the
+// endpoint the client connects to.
+func NewS3Store(client *minio.Client, bucket, prefix string) *S3Store {
+	return &S3Store{client, bucket, prefix}
+}
+
+func (s *S3Store) key(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *S3Store) Get(name string) ([]byte, string, error) {
+	ctx := context.Background()
+	obj, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, "", s3Error(err)
+	}
+	defer obj.Close()
+
+	info, err := obj.Stat()
+	if err != nil {
+		return nil, "", s3Error(err)
+	}
+	content, err := ioutil.ReadAll(obj)
+	if err != nil {
+		return nil, "", s3Error(err)
+	}
+	return content, info.ETag, nil
+}
+
+func (s *S3Store) Put(name string, content []byte, version string) (string, error) {
+	opts := minio.PutObjectOptions{ContentType: "application/octet-stream"}
+	if len(version) == 0 {
+		opts.SetMatchETagExcept("*")
+	} else {
+		opts.SetMatchETag(version)
+	}
+
+	info, err := s.client.PutObject(context.Background(), s.bucket, s.key(name), bytes.NewReader(content), int64(len(content)), opts)
+	if err != nil {
+		return "", s3Error(err)
+	}
+	return info.ETag, nil
+}
+
+func (s *S3Store) Delete(name string) error {
+	return s3Error(s.client.RemoveObject(context.Background(), s.bucket, s.key(name), minio.RemoveObjectOptions{}))
+}
+
+func (s *S3Store) String() string {
+	return "s3://" + path.Join(s.bucket, s.prefix)
+}
+
+// s3Error maps the S3 errors to those of a Store.
+func s3Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	resp := minio.ToErrorResponse(err)
+	switch {
+	case resp.Code == "NoSuchKey" || resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.Code == "PreconditionFailed" || resp.StatusCode == http.StatusPreconditionFailed:
+		return ErrConflict
+	}
+	return err
+}
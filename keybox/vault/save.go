@@ -0,0 +1,178 @@
+package vault
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	backupSuffix = ".bak"
+	backupTime   = "20060102T150405.000000000Z"
+)
+
+// WriteFileAtomic replaces path with content so that a crash leaves either
+// the old or the new file, never a partial one: the content goes to a
+// temporary file in the same directory, which is synced, renamed over path,
+// and the directory is synced so that the rename itself is durable.
+func WriteFileAtomic(path string, content []byte, perm os.FileMode) (err error) {
+	dir, base := filepath.Split(path)
+	if len(dir) == 0 {
+		dir = "."
+	}
+
+	f, err := ioutil.TempFile(dir, "."+base+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if err = f.Chmod(perm); err != nil {
+		return err
+	}
+	if _, err = f.Write(content); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	// not supported everywhere, e.g. on windows, the rename is done anyway
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Backup copies the vault file at path to a timestamped backup next to it,
+// before it is rewritten, and removes all but the n newest backups. No
+// backup is made for n <= 0.
+func Backup(path string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	name := path + "." + time.Now().UTC().Format(backupTime) + backupSuffix
+	if err := WriteFileAtomic(name, content, 0600); err != nil {
+		return err
+	}
+
+	backups, err := Backups(path)
+	if err != nil {
+		return err
+	}
+	for _, b := range backups[min(n, len(backups)):] {
+		if !strings.HasSuffix(b, ".sav") {
+			os.Remove(b)
+		}
+	}
+	return nil
+}
+
+// Backups returns the backups of the vault file at path, newest first. A
+// .sav file left by older versions comes last.
+func Backups(path string) ([]string, error) {
+	backups, err := filepath.Glob(globEscape(path) + ".*" + backupSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	// the timestamps sort lexically
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	if _, err := os.Stat(path + ".sav"); err == nil {
+		backups = append(backups, path+".sav")
+	}
+	return backups, nil
+}
+
+// The attachments that the vault file no longer holds stay in the directory
+// of a FileStore keeping backups, as the backups made before refer to them:
+// they are marked retired with the time, and removed once the oldest backup
+// is younger. Attachments in use again, e.g. after a restore, lose the mark.
+
+const retiredMark = "retired"
+
+func (s *FileStore) retireAttachment(id string) bool {
+	if s.Backups <= 0 {
+		return false
+	}
+	mark := filepath.Join(s.Path+".d", "attachments", id, retiredMark)
+	if _, err := os.Stat(mark); err == nil {
+		return true
+	}
+	return WriteFileAtomic(mark, []byte(time.Now().UTC().Format(time.RFC3339Nano)), 0600) == nil
+}
+
+func (s *FileStore) keepAttachments(live map[string]Attachment) {
+	if s.Backups <= 0 {
+		return
+	}
+	dirs, err := filepath.Glob(filepath.Join(globEscape(s.Path+".d"), "attachments", "*"))
+	if err != nil {
+		return
+	}
+	oldest := s.oldestBackup()
+	for _, dir := range dirs {
+		id, mark := filepath.Base(dir), filepath.Join(dir, retiredMark)
+		if _, found := live[id]; found {
+			os.Remove(mark)
+			continue
+		}
+		// not in use, e.g. replaced by a restore, or attached by another
+		// process that has yet to save: retired, and in no backup made since
+		if !s.retireAttachment(id) {
+			continue
+		}
+		content, err := ioutil.ReadFile(mark)
+		if err != nil {
+			continue
+		}
+		retired, err := time.Parse(time.RFC3339Nano, string(content))
+		if err == nil && !oldest.IsZero() && retired.Before(oldest) {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+// oldestBackup returns the time of the oldest timestamped backup, zero if
+// there is none.
+func (s *FileStore) oldestBackup() time.Time {
+	backups, _ := Backups(s.Path)
+	var oldest time.Time
+	for _, b := range backups {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(b, s.Path+"."), backupSuffix)
+		if t, err := time.Parse(backupTime, stamp); err == nil && (oldest.IsZero() || t.Before(oldest)) {
+			oldest = t
+		}
+	}
+	return oldest
+}
+
+func globEscape(path string) string {
+	r := strings.NewReplacer("*", "\\*", "?", "\\?", "[", "\\[", "\\", "\\\\")
+	return r.Replace(path)
+}
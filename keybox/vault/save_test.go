@@ -0,0 +1,66 @@
+package vault
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vault")
+	for _, content := range []string{"first", "second"} {
+		if err := WriteFileAtomic(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadFile(path); string(b) != content {
+			t.Errorf("got %q, want %q", b, content)
+		}
+	}
+
+	finfo, err := os.Stat(path)
+	if err != nil || finfo.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, %v", finfo.Mode(), err)
+	}
+
+	// no temporary file is left behind
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files in %s", len(files), dir)
+	}
+}
+
+func TestBackupRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault[1]")
+	for i := 0; i < 5; i++ {
+		if err := ioutil.WriteFile(path, []byte(strconv.Itoa(i)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := Backup(path, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := Backups(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 3 {
+		t.Fatalf("%d backups: %v", len(backups), backups)
+	}
+	for i, b := range backups {
+		if content, _ := ioutil.ReadFile(b); string(content) != strconv.Itoa(4-i) {
+			t.Errorf("backup %d has %q", i, content)
+		}
+	}
+
+	for _, n := range []int{0, -1} {
+		if err := Backup(path, n); err != nil {
+			t.Errorf("%d backups: %v", n, err)
+		}
+	}
+	if backups, _ := Backups(path); len(backups) != 3 {
+		t.Errorf("%d backups after backups turned off", len(backups))
+	}
+}
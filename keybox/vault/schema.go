@@ -0,0 +1,124 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// schemaVersion is the version of the decrypted payload. Version 1 payloads
+// are a bare map of name to {Name, Login, Password}; they are migrated when
+// loaded and written back in the current schema on the next save. Version 3
+// added the password history and the vault log, version 4 the OTP secrets,
+// version 5 the members of team vaults, version 6 the tombstones of deleted
+// keys, version 7 the ids of keys kept one per object, version 8 the SSH
+// keys and version 9 the attachments.
+const schemaVersion = 9
+
+// Key is an entry of the vault.
+type Key struct {
+	Name        string
+	Login       string
+	Password    string
+	URL         string           `json:",omitempty"`
+	Notes       string           `json:",omitempty"`
+	Tags        []string         `json:",omitempty"`
+	Fields      []Field          `json:",omitempty"`
+	History     []PasswordChange `json:",omitempty"`
+	OTP         *OTP             `json:",omitempty"`
+	SSH         *SSHKey          `json:",omitempty"`
+	Attachments []Attachment     `json:",omitempty"`
+	Created     time.Time
+	Modified    time.Time
+}
+
+// Field is a custom, per-key value such as a recovery code or a PIN. Type
+// is text, hidden or url.
+type Field struct {
+	Name  string
+	Type  string
+	Value string
+}
+
+// PasswordChange is a previous password of a key and when it was replaced.
+type PasswordChange struct {
+	Password string
+	Changed  time.Time
+}
+
+// LogRecord is an entry of the append-only log of the operations on the
+// vault. It is part of the encrypted payload and never holds secrets.
+type LogRecord struct {
+	Time time.Time
+	Op   string
+	Name string `json:",omitempty"`
+}
+
+// SetField adds or replaces the custom field f.
+func (k *Key) SetField(f Field) {
+	for i := range k.Fields {
+		if k.Fields[i].Name == f.Name {
+			k.Fields[i] = f
+			return
+		}
+	}
+	k.Fields = append(k.Fields, f)
+}
+
+type payload struct {
+	Schema  int
+	Keys    map[string]Key
+	Log     []LogRecord `json:",omitempty"`
+	Members []Member    `json:",omitempty"`
+
+	// Deleted is when each deleted key was removed, so that a merge does
+	// not bring it back from another copy of the vault.
+	Deleted map[string]time.Time `json:",omitempty"`
+
+	// Entries are the ids of the objects of the keys, by name, when the
+	// store keeps one object per key. Keys is empty then.
+	Entries map[string]string `json:",omitempty"`
+}
+
+// parsePayload decodes and migrates a payload of any schema version.
+// modified is used as the timestamp of keys that have none.
+func parsePayload(data []byte, modified time.Time) (*payload, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+
+	// a v1 key named Schema would be an object, not a number
+	var p payload
+	if err := json.Unmarshal(probe["Schema"], &p.Schema); err != nil || p.Schema == 0 {
+		p.Schema = 1
+		if err := json.Unmarshal(data, &p.Keys); err != nil {
+			return nil, err
+		}
+	} else if p.Schema > schemaVersion {
+		return nil, fmt.Errorf("Unsupported schema version %d, upgrade keybox", p.Schema)
+	} else if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+
+	if p.Keys == nil {
+		p.Keys = make(map[string]Key)
+	}
+	if p.Deleted == nil {
+		p.Deleted = make(map[string]time.Time)
+	}
+	migrateKeys(p.Keys, modified)
+	return &p, nil
+}
+
+func migrateKeys(ks map[string]Key, modified time.Time) {
+	for name, k := range ks {
+		if k.Created.IsZero() {
+			k.Created = modified
+		}
+		if k.Modified.IsZero() {
+			k.Modified = k.Created
+		}
+		ks[name] = k
+	}
+}
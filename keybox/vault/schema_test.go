@@ -0,0 +1,69 @@
+package vault
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePayloadV1(t *testing.T) {
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	v1 := `{"Schema":{"Name":"Schema","Login":"me","Password":"pw"},"gh":{"Name":"gh","Login":"me","Password":"pw"}}`
+	p, err := parsePayload([]byte(v1), modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.Keys) != 2 || p.Keys["gh"].Password != "pw" || p.Keys["Schema"].Login != "me" {
+		t.Errorf("unexpected keys %+v", p.Keys)
+	}
+	if !p.Keys["gh"].Created.Equal(modified) || !p.Keys["gh"].Modified.Equal(modified) {
+		t.Errorf("timestamps not migrated: %+v", p.Keys["gh"])
+	}
+
+	p.Schema = schemaVersion
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, err = parsePayload(data, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if !p.Keys["gh"].Created.Equal(modified) {
+		t.Errorf("timestamps lost: %+v", p.Keys["gh"])
+	}
+}
+
+func TestPutHistory(t *testing.T) {
+	v := &Vault{keys: make(map[string]Key)}
+
+	v.Put(Key{Name: "gh", Login: "me", Password: "one"})
+	k, _ := v.Get("gh")
+	created := k.Created
+	v.Put(Key{Name: "gh", Login: "me", Password: "two"})
+	v.Put(Key{Name: "gh", Login: "me2", Password: "two"})
+
+	k, _ = v.Get("gh")
+	if len(k.History) != 1 || k.History[0].Password != "one" {
+		t.Errorf("unexpected history %+v", k.History)
+	}
+	if !k.Created.Equal(created) {
+		t.Errorf("created changed from %s to %s", created, k.Created)
+	}
+
+	if !v.Delete("gh") || v.Delete("gh") {
+		t.Error("Delete")
+	}
+	if _, found := v.deleted["gh"]; !found {
+		t.Error("no tombstone")
+	}
+
+	var ops []string
+	for _, r := range v.Log() {
+		ops = append(ops, r.Op)
+	}
+	if strings.Join(ops, ",") != "add,update,update,delete" {
+		t.Errorf("unexpected log %v", ops)
+	}
+}
@@ -0,0 +1,109 @@
+package vault
+
+import (
+	crand "crypto/rand"
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"os"
+	"strconv"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore keeps the objects of a vault in a table of an SQLite
+// database. The version of an object is a random number drawn by every
+// write, so that it does not repeat even when the object is deleted and
+// created again, and the check and the write are a single statement.
+type SQLiteStore struct {
+	path string
+	db   *sql.DB
+}
+
+// OpenSQLiteStore opens the database at path, creating it and its table if
+// needed. A new database is readable by its owner only.
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS keybox_objects (
+		name    TEXT PRIMARY KEY,
+		content BLOB NOT NULL,
+		version INTEGER NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{path, db}, nil
+}
+
+func (s *SQLiteStore) Get(name string) ([]byte, string, error) {
+	var content []byte
+	var version int64
+	err := s.db.QueryRow(`SELECT content, version FROM keybox_objects WHERE name = ?`, name).Scan(&content, &version)
+	if err == sql.ErrNoRows {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return content, strconv.FormatInt(version, 10), nil
+}
+
+func (s *SQLiteStore) Put(name string, content []byte, version string) (string, error) {
+	next, err := newSQLiteVersion()
+	if err != nil {
+		return "", err
+	}
+
+	var res sql.Result
+	if len(version) == 0 {
+		res, err = s.db.Exec(`INSERT OR IGNORE INTO keybox_objects (name, content, version) VALUES (?, ?, ?)`, name, content, next)
+	} else {
+		current, perr := strconv.ParseInt(version, 10, 64)
+		if perr != nil {
+			return "", ErrConflict
+		}
+		res, err = s.db.Exec(`UPDATE keybox_objects SET content = ?, version = ? WHERE name = ? AND version = ?`, content, next, name, current)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if n == 0 {
+		return "", ErrConflict
+	}
+	return strconv.FormatInt(next, 10), nil
+}
+
+func newSQLiteVersion() (int64, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(crand.Reader, b); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b) >> 1), nil
+}
+
+func (s *SQLiteStore) Delete(name string) error {
+	_, err := s.db.Exec(`DELETE FROM keybox_objects WHERE name = ?`, name)
+	return err
+}
+
+func (s *SQLiteStore) String() string {
+	return "sqlite:" + s.path
+}
+
+// Close closes the database.
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
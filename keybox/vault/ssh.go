@@ -0,0 +1,115 @@
+package vault
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHKey is an SSH private key of a key, with the constraints an agent
+// holds it under. The private key is kept unencrypted in the OpenSSH format,
+// the vault encrypts it.
+type SSHKey struct {
+	PrivateKey string
+	Comment    string `json:",omitempty"`
+	Confirm    bool   `json:",omitempty"` // ask before every signature
+	Lifetime   int    `json:",omitempty"` // seconds the agent holds it, 0 for as long as it runs
+}
+
+// SSHKeyTypes are the types of keys GenerateSSHKey makes.
+var SSHKeyTypes = []string{"ed25519", "ecdsa", "rsa"}
+
+// ErrSSHPassphrase is returned by ParseSSHKey for an encrypted key given
+// without its passphrase.
+var ErrSSHPassphrase = errors.New("SSH key is encrypted")
+
+// ParseSSHKey reads an ed25519, RSA or ECDSA private key in PEM, in the
+// OpenSSH, PKCS#1, PKCS#8 or SEC 1 format. An encrypted key is decrypted
+// with passphrase.
+func ParseSSHKey(data, passphrase []byte) (*SSHKey, error) {
+	raw, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if len(passphrase) == 0 {
+			return nil, ErrSSHPassphrase
+		}
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SSH key: %s", err)
+	}
+	return newSSHKey(raw)
+}
+
+// GenerateSSHKey makes a new key of type t, one of SSHKeyTypes.
+func GenerateSSHKey(t string) (*SSHKey, error) {
+	var raw interface{}
+	var err error
+	switch t {
+	case "ed25519":
+		_, raw, err = ed25519.GenerateKey(crand.Reader)
+	case "ecdsa":
+		raw, err = ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	case "rsa":
+		raw, err = rsa.GenerateKey(crand.Reader, 3072)
+	default:
+		return nil, fmt.Errorf("Unsupported SSH key type %s", t)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newSSHKey(raw)
+}
+
+func newSSHKey(raw interface{}) (*SSHKey, error) {
+	switch raw.(type) {
+	case ed25519.PrivateKey, *ed25519.PrivateKey, *rsa.PrivateKey, *ecdsa.PrivateKey:
+	default:
+		return nil, fmt.Errorf("Unsupported SSH key %T, expected ed25519, RSA or ECDSA", raw)
+	}
+
+	block, err := ssh.MarshalPrivateKey(raw, "")
+	if err != nil {
+		return nil, err
+	}
+	return &SSHKey{PrivateKey: string(pem.EncodeToMemory(block))}, nil
+}
+
+// RawKey returns the private key, as the ssh agent package takes it.
+func (s *SSHKey) RawKey() (interface{}, error) {
+	raw, err := ssh.ParseRawPrivateKey([]byte(s.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SSH key: %s", err)
+	}
+	return raw, nil
+}
+
+// PublicKey returns the public half of the key.
+func (s *SSHKey) PublicKey() (ssh.PublicKey, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(s.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SSH key: %s", err)
+	}
+	return signer.PublicKey(), nil
+}
+
+// AuthorizedKey formats the public key as a line of authorized_keys.
+func (s *SSHKey) AuthorizedKey() (string, error) {
+	pub, err := s.PublicKey()
+	if err != nil {
+		return "", err
+	}
+	line := string(ssh.MarshalAuthorizedKey(pub))
+	line = line[:len(line)-1]
+	if len(s.Comment) > 0 {
+		line += " " + s.Comment
+	}
+	return line, nil
+}
@@ -0,0 +1,54 @@
+package vault
+
+import (
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHKey(t *testing.T) {
+	for _, typ := range SSHKeyTypes {
+		s, err := GenerateSSHKey(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Comment = "me@host"
+		line, err := s.AuthorizedKey()
+		if err != nil || !strings.HasSuffix(line, " me@host") {
+			t.Errorf("%s: authorized key %q, %v", typ, line, err)
+		}
+
+		raw, err := s.RawKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, err := ssh.MarshalPrivateKeyWithPassphrase(raw, "", []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		encrypted := pem.EncodeToMemory(block)
+		if _, err := ParseSSHKey(encrypted, nil); err != ErrSSHPassphrase {
+			t.Errorf("%s: encrypted without passphrase: got %v, want ErrSSHPassphrase", typ, err)
+		}
+		if _, err := ParseSSHKey(encrypted, []byte("wrong")); err == nil {
+			t.Errorf("%s: wrong passphrase accepted", typ)
+		}
+		parsed, err := ParseSSHKey(encrypted, []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed.Comment = s.Comment
+		if l, _ := parsed.AuthorizedKey(); l != line {
+			t.Errorf("%s: got %q after decrypting, want %q", typ, l, line)
+		}
+	}
+
+	if _, err := GenerateSSHKey("dsa"); err == nil {
+		t.Error("generated a DSA key")
+	}
+	if _, err := ParseSSHKey([]byte("not a key"), nil); err == nil {
+		t.Error("parsed garbage")
+	}
+}
@@ -0,0 +1,219 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A Store keeps the encrypted objects of a vault: the vault file itself,
+// named "vault", the chunks of the attachments under "attachments/" and in
+// stores that keep one object per key, see DirStore, an object per key under
+// "keys/". Stores never see anything in clear.
+//
+// Every object has a version token that changes whenever it is written.
+// Writes are conditional on the version read before, so that two writers
+// that did not see each other's change cannot overwrite it.
+type Store interface {
+	// Get returns the object name and its version, ErrNotFound if there is
+	// none.
+	Get(name string) (content []byte, version string, err error)
+
+	// Put replaces the object name if its version is still version, or
+	// creates it if version is "" and there is none yet. It returns the new
+	// version, or ErrConflict.
+	Put(name string, content []byte, version string) (string, error)
+
+	// Delete removes the object name, if there is one.
+	Delete(name string) error
+
+	// String describes where the objects are kept, for messages.
+	String() string
+}
+
+// The errors of a Store.
+var (
+	ErrNotFound = errors.New("Not found")
+	ErrConflict = errors.New("Changed by another process")
+)
+
+const vaultObject = "vault"
+
+// FileStore keeps a vault as a single file, and its attachments in a
+// directory next to it, the path of the file with ".d" appended. Put backs
+// the file up before it replaces it. The version of the file is a hash of
+// its content; the check and the write are not atomic, writers should hold
+// the Lock of the file.
+type FileStore struct {
+	Path string
+
+	// Backups is the number of backups kept by Put.
+	Backups int
+}
+
+// NewFileStore returns the store of the vault file at path, keeping
+// DefaultBackups backups.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path, Backups: DefaultBackups}
+}
+
+// objects returns the store of the attachments.
+func (s *FileStore) objects(name string) (*DirStore, bool) {
+	return NewDirStore(s.Path + ".d"), strings.HasPrefix(name, "attachments/")
+}
+
+func (s *FileStore) Get(name string) ([]byte, string, error) {
+	if d, ok := s.objects(name); ok {
+		return d.Get(name)
+	}
+	if name != vaultObject {
+		return nil, "", ErrNotFound
+	}
+	return getFile(s.Path)
+}
+
+func (s *FileStore) Put(name string, content []byte, version string) (string, error) {
+	if d, ok := s.objects(name); ok {
+		return d.Put(name, content, version)
+	}
+	if name != vaultObject {
+		return "", fmt.Errorf("%s holds a single file, not %s", s.Path, name)
+	}
+	return putFile(s.Path, content, version, func() error {
+		if err := Backup(s.Path, s.Backups); err != nil {
+			return fmt.Errorf("Cannot back up %s: %s", s.Path, err)
+		}
+		return nil
+	})
+}
+
+func (s *FileStore) Delete(name string) error {
+	if d, ok := s.objects(name); ok {
+		return d.Delete(name)
+	}
+	if name != vaultObject {
+		return nil
+	}
+	return deleteFile(s.Path)
+}
+
+func (s *FileStore) String() string {
+	return s.Path
+}
+
+// DirStore keeps a vault in a directory with one file per key, so that a
+// change writes only the keys that changed. The keys are in keys/, named by
+// random ids, the names are only in the vault file.
+type DirStore struct {
+	Dir string
+}
+
+// NewDirStore returns the store of the vault in dir.
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{Dir: dir}
+}
+
+// PerEntry tells Create to keep one object per key.
+func (s *DirStore) PerEntry() bool {
+	return true
+}
+
+func (s *DirStore) path(name string) (string, error) {
+	if strings.Contains(name, "..") {
+		return "", fmt.Errorf("Invalid object name %s", name)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(name)), nil
+}
+
+func (s *DirStore) Get(name string) ([]byte, string, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, "", err
+	}
+	return getFile(path)
+}
+
+func (s *DirStore) Put(name string, content []byte, version string) (string, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	return putFile(path, content, version, nil)
+}
+
+func (s *DirStore) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := deleteFile(path); err != nil {
+		return err
+	}
+	if strings.Count(name, "/") > 1 {
+		os.Remove(filepath.Dir(path)) // the chunks of an attachment, once all gone
+	}
+	return nil
+}
+
+func (s *DirStore) String() string {
+	return s.Dir
+}
+
+// perEntry reports whether new vaults in s keep one object per key.
+func perEntry(s Store) bool {
+	e, ok := s.(interface{ PerEntry() bool })
+	return ok && e.PerEntry()
+}
+
+func fileVersionToken(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:16])
+}
+
+func getFile(path string) ([]byte, string, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return content, fileVersionToken(content), nil
+}
+
+// putFile atomically replaces path if its content still has version,
+// running before first if it is not nil.
+func putFile(path string, content []byte, version string, before func() error) (string, error) {
+	_, current, err := getFile(path)
+	if err != nil && err != ErrNotFound {
+		return "", err
+	}
+	if current != version {
+		return "", ErrConflict
+	}
+
+	if before != nil {
+		if err := before(); err != nil {
+			return "", err
+		}
+	}
+	if err := WriteFileAtomic(path, content, 0600); err != nil {
+		return "", fmt.Errorf("Failed to save file %s: %s", path, err)
+	}
+	return fileVersionToken(content), nil
+}
+
+func deleteFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
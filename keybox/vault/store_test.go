@@ -0,0 +1,158 @@
+package vault
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// testStore checks the version tokens of s on the object name.
+func testStore(t *testing.T, s Store, name string) {
+	if _, _, err := s.Get(name); err != ErrNotFound {
+		t.Fatalf("%s: get before put: got %v, want ErrNotFound", s, err)
+	}
+	v1, err := s.Put(name, []byte("one"), "")
+	if err != nil {
+		t.Fatalf("%s: create: %v", s, err)
+	}
+	if _, err := s.Put(name, []byte("again"), ""); err != ErrConflict {
+		t.Errorf("%s: create twice: got %v, want ErrConflict", s, err)
+	}
+
+	v2, err := s.Put(name, []byte("two"), v1)
+	if err != nil || v2 == v1 {
+		t.Fatalf("%s: update: %q, %v", s, v2, err)
+	}
+	if _, err := s.Put(name, []byte("stale"), v1); err != ErrConflict {
+		t.Errorf("%s: stale update: got %v, want ErrConflict", s, err)
+	}
+	if content, v, err := s.Get(name); err != nil || string(content) != "two" || v != v2 {
+		t.Errorf("%s: get: %q, %q, %v", s, content, v, err)
+	}
+
+	if err := s.Delete(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Get(name); err != ErrNotFound {
+		t.Errorf("%s: get after delete: got %v, want ErrNotFound", s, err)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	testStore(t, NewFileStore(filepath.Join(dir, "vault")), "vault")
+	testStore(t, NewDirStore(dir), "keys/0123")
+}
+
+func TestSQLiteStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault.db")
+	s, err := OpenSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStore(t, s, "vault")
+	if fi, err := os.Stat(path); err != nil || runtime.GOOS != "windows" && fi.Mode().Perm() != 0600 {
+		t.Errorf("database mode %v, %v", fi.Mode(), err)
+	}
+
+	// deleted and created again, the old version is stale
+	v1, _ := s.Put("vault", []byte("one"), "")
+	s.Delete("vault")
+	if _, err := s.Put("vault", []byte("two"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Put("vault", []byte("stale"), v1); err != ErrConflict {
+		t.Errorf("stale update after recreate: got %v, want ErrConflict", err)
+	}
+}
+
+func TestS3Store(t *testing.T) {
+	testStore(t, newTestS3Store(t), "keys/0123")
+}
+
+// fakeS3 is a stand-in for an S3-compatible store with conditional writes,
+// just enough of it for S3Store.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) etag(content []byte) string {
+	sum := md5.Sum(content)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fail := func(status int, code string) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+	}
+
+	content, found := f.objects[r.URL.Path]
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if !found {
+			fail(http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", f.etag(content))
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		if r.Method == http.MethodGet {
+			w.Write(content)
+		}
+	case http.MethodPut:
+		if m := r.Header.Get("If-None-Match"); m == "*" && found {
+			fail(http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if m := r.Header.Get("If-Match"); len(m) > 0 && (!found || m != f.etag(content)) {
+			fail(http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[r.URL.Path] = body
+		w.Header().Set("ETag", f.etag(body))
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fail(http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func newTestS3Store(t *testing.T) *S3Store {
+	srv := httptest.NewTLSServer(&fakeS3{objects: make(map[string][]byte)})
+	t.Cleanup(srv.Close)
+
+	u, _ := url.Parse(srv.URL)
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:        credentials.NewStaticV4("key", "secret", ""),
+		Secure:       true,
+		Region:       "us-east-1",
+		Transport:    srv.Client().Transport,
+		BucketLookup: minio.BucketLookupPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewS3Store(client, "bucket", strings.Trim(t.Name(), "/"))
+}
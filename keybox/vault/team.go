@@ -0,0 +1,160 @@
+package vault
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"filippo.io/age"
+)
+
+// A team vault has no passphrase. Its data key is encrypted with age to the
+// X25519 public key of every member and stored as the wrapped key of the
+// header, so that each member opens the vault with their own private key.
+// The members are listed in the encrypted payload. Removing a member
+// replaces the data key.
+
+// ErrNotMember is returned by UnlockIdentities when none of the identities
+// is a member of the team vault.
+var ErrNotMember = errors.New("You are not a member of this team vault")
+
+// Member is a person or machine that can open a team vault.
+type Member struct {
+	Name      string
+	Recipient string // age1...
+	Added     time.Time
+}
+
+// Team reports whether v is a team vault.
+func (v *Vault) Team() bool {
+	return v.kdf.KDF == KDFAge
+}
+
+// UnlockIdentities decrypts a team vault with the data key unwrapped by one
+// of the age identities.
+func (v *Vault) UnlockIdentities(ids ...age.Identity) error {
+	if !v.Team() {
+		return errors.New("Not a team vault")
+	}
+	k, err := unwrapTeamKey(v.hdr.Wrapped, ids)
+	if err != nil {
+		return err
+	}
+	return v.UnlockKey(k)
+}
+
+// Members returns the members of a team vault.
+func (v *Vault) Members() []Member {
+	return append([]Member(nil), v.members...)
+}
+
+// MakeTeam turns v into a team vault with a new data key. It can no longer
+// be opened with the passphrase, and with nobody at all until a member is
+// added.
+func (v *Vault) MakeTeam() error {
+	if v.Team() {
+		return nil
+	}
+	k, err := newDataKey()
+	if err != nil {
+		return err
+	}
+	v.kdf, v.key = &KDFParams{KDF: KDFAge}, k
+	return nil
+}
+
+// AddMember gives m access to the team vault.
+func (v *Vault) AddMember(m Member) error {
+	if !v.Team() {
+		return errors.New("Not a team vault")
+	}
+	if _, err := age.ParseX25519Recipient(m.Recipient); err != nil {
+		return fmt.Errorf("Invalid age recipient %s: %s", m.Recipient, err)
+	}
+	for _, o := range v.members {
+		if o.Name == m.Name {
+			return fmt.Errorf("Member %s exists already", m.Name)
+		}
+		if o.Recipient == m.Recipient {
+			return fmt.Errorf("%s is already the key of %s", m.Recipient, o.Name)
+		}
+	}
+
+	v.members = append(v.members, m)
+	return nil
+}
+
+// RemoveMember takes the access to the team vault away from the member
+// name. The data key and the keys of the attachments are replaced, as the
+// member knows the old ones.
+func (v *Vault) RemoveMember(name string) error {
+	if !v.Team() {
+		return errors.New("Not a team vault")
+	}
+	for i, m := range v.members {
+		if m.Name == name {
+			k, err := newDataKey()
+			if err != nil {
+				return err
+			}
+			v.members = append(append([]Member(nil), v.members[:i]...), v.members[i+1:]...)
+			v.key = k
+			return v.rotateAttachments()
+		}
+	}
+	return fmt.Errorf("Member %s not found", name)
+}
+
+// unwrapTeamKey decrypts the data key of a team vault with the identities.
+func unwrapTeamKey(wrapped []byte, ids []age.Identity) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(wrapped), ids...)
+	var noMatch *age.NoIdentityMatchError
+	if errors.As(err, &noMatch) {
+		return nil, ErrNotMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(io.LimitReader(r, dataKeySize+1))
+}
+
+// wrapTeamKey encrypts the data key to every member.
+func wrapTeamKey(dataKey []byte, ms []Member) ([]byte, error) {
+	if len(ms) == 0 {
+		return nil, errors.New("Team vault without members")
+	}
+
+	var recipients []age.Recipient
+	for _, m := range ms {
+		r, err := age.ParseX25519Recipient(m.Recipient)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid recipient of %s: %s", m.Name, err)
+		}
+		recipients = append(recipients, r)
+	}
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(dataKey); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func newDataKey() ([]byte, error) {
+	k := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(crand.Reader, k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
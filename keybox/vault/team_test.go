@@ -0,0 +1,99 @@
+package vault
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func newIdentity(t *testing.T) *age.X25519Identity {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestTeamKey(t *testing.T) {
+	alice, bob := newIdentity(t), newIdentity(t)
+
+	dataKey := bytes.Repeat([]byte{7}, dataKeySize)
+	wrapped, err := wrapTeamKey(dataKey, []Member{
+		{Name: "alice", Recipient: alice.Recipient().String()},
+		{Name: "bob", Recipient: bob.Recipient().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []age.Identity{alice, bob} {
+		if k, err := unwrapTeamKey(wrapped, []age.Identity{id}); err != nil || !bytes.Equal(k, dataKey) {
+			t.Errorf("unwrap: %x, %v", k, err)
+		}
+	}
+	if _, err := unwrapTeamKey(wrapped, []age.Identity{newIdentity(t)}); err != ErrNotMember {
+		t.Errorf("stranger: got %v, want ErrNotMember", err)
+	}
+
+	if _, err := wrapTeamKey(dataKey, nil); err == nil {
+		t.Error("wrapped for no members")
+	}
+}
+
+func TestTeamVault(t *testing.T) {
+	alice, bob := newIdentity(t), newIdentity(t)
+	path := filepath.Join(t.TempDir(), "vault")
+
+	v, err := Create(NewFileStore(path), &KDFParams{KDF: KDFSHA256}, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Put(Key{Name: "gh", Password: "one"})
+	if err := v.MakeTeam(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []Member{{Name: "alice", Recipient: alice.Recipient().String()}, {Name: "bob", Recipient: bob.Recipient().String()}} {
+		if err := v.AddMember(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := v.AddMember(Member{Name: "alice", Recipient: newIdentity(t).Recipient().String()}); err == nil {
+		t.Error("added alice twice")
+	}
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(id age.Identity) (*Vault, error) {
+		v, err := Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return v, v.UnlockIdentities(id)
+	}
+	b, err := open(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, _ := b.Get("gh"); k.Password != "one" || len(b.Members()) != 2 {
+		t.Errorf("bob opened %+v with members %v", k, b.Members())
+	}
+	if err := b.Unlock("pw"); err == nil {
+		t.Error("team vault unlocked with the passphrase")
+	}
+
+	if err := b.RemoveMember("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open(alice); err != ErrNotMember {
+		t.Errorf("removed member: got %v, want ErrNotMember", err)
+	}
+	if _, err := open(bob); err != nil {
+		t.Errorf("remaining member: %v", err)
+	}
+}
@@ -0,0 +1,426 @@
+// Package vault reads and writes keybox vault files.
+//
+// A vault is opened with Open, which reads the file, or with OpenStore from
+// any Store, then decrypted with Unlock, UnlockKey or, for a team vault,
+// UnlockIdentities. The keys are changed in memory with Put and Delete and
+// written back with Save. Writers to a local store should hold the lock
+// taken with Lock from before Open until after Save. Nothing in this package
+// prompts or exits, every failure is an error.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// DefaultBackups is the number of backups a FileStore keeps by default.
+const DefaultBackups = 5
+
+// ErrNotUnlocked is returned when the keys of a vault are used before it is
+// unlocked.
+var ErrNotUnlocked = errors.New("Vault is not unlocked")
+
+// ErrUpgrade is returned when a v1 vault is saved without a new passphrase
+// key derivation, see SetPassphrase, since its unsalted one is not written
+// to a new file.
+var ErrUpgrade = errors.New("Vault uses the v1 format, set its passphrase again to upgrade it")
+
+// Vault is a vault file and, once unlocked, its keys.
+type Vault struct {
+	store    Store
+	version  string // of the vault file as opened, "" for a new vault
+	content  []byte // the vault file as opened
+	modified time.Time
+	hdr      *header
+	kdf      *KDFParams
+	key      []byte // the passphrase key, or the data key of a team vault
+	unlocked bool
+
+	keys    map[string]Key
+	log     []LogRecord
+	members []Member
+	deleted map[string]time.Time
+
+	// the keys kept one per object, see entries.go
+	perEntry   bool
+	stored     map[string]storedEntry
+	entriesKey []byte
+
+	// the attachments in the vault file as saved and those attached since,
+	// see attach.go
+	saved   map[string]Attachment
+	pending map[string]Attachment
+}
+
+// Open reads the vault file at path. It has to be unlocked before its keys
+// can be used.
+func Open(path string) (*Vault, error) {
+	return OpenStore(NewFileStore(path))
+}
+
+// OpenStore reads the vault kept in s, ErrNotFound if there is none.
+func OpenStore(s Store) (*Vault, error) {
+	content, version, err := s.Get(vaultObject)
+	if err != nil {
+		return nil, err
+	}
+	v, err := Load(content)
+	if err != nil {
+		return nil, err
+	}
+	v.store, v.version = s, version
+	if fs, ok := s.(*FileStore); ok {
+		if finfo, err := os.Stat(fs.Path); err == nil {
+			v.modified = finfo.ModTime()
+		}
+	}
+	return v, nil
+}
+
+// Load reads a vault file that is not in a store, e.g. another copy or an
+// older version of it. It cannot be saved.
+func Load(content []byte) (*Vault, error) {
+	v := &Vault{content: content, modified: time.Now()}
+	v.keys, v.deleted = make(map[string]Key), make(map[string]time.Time)
+	if fileVersion(content) == FormatV1 {
+		v.hdr, v.kdf = &header{Version: FormatV1}, &KDFParams{KDF: KDFSHA256}
+		return v, nil
+	}
+
+	h, _, err := parseHeader(content)
+	if err != nil {
+		return nil, err
+	}
+	if v.kdf, err = parseKDFParams(h.KDF, h.KDFParams); err != nil {
+		return nil, err
+	}
+	v.hdr = h
+	return v, nil
+}
+
+// Create returns a new, empty and unlocked vault to be saved in s, where
+// there must be no vault yet.
+func Create(s Store, p *KDFParams, passphrase string) (*Vault, error) {
+	if _, _, err := s.Get(vaultObject); err != ErrNotFound {
+		if err == nil {
+			err = fmt.Errorf("%s already exists", s)
+		}
+		return nil, err
+	}
+	k, err := DeriveKey(passphrase, p)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Vault{store: s, hdr: &header{}, kdf: p, key: k, perEntry: perEntry(s)}
+	v.setPayload(&payload{Keys: make(map[string]Key), Deleted: make(map[string]time.Time)})
+	v.LogOp("create", "")
+	return v, nil
+}
+
+// Version returns the format version of the file, FormatV3 for a new vault.
+func (v *Vault) Version() byte {
+	if v.hdr.Version == 0 {
+		return FormatV3
+	}
+	return v.hdr.Version
+}
+
+// Content returns the file as it was read from the store.
+func (v *Vault) Content() []byte {
+	return v.content
+}
+
+// KDF returns the key derivation parameters of the passphrase.
+func (v *Vault) KDF() *KDFParams {
+	return v.kdf
+}
+
+// Key returns the key that unlocks the vault, for UnlockKey. It is the
+// passphrase key or, for a team vault, the data key.
+func (v *Vault) Key() []byte {
+	return v.key
+}
+
+// Unlock decrypts the vault with the key derived from passphrase.
+func (v *Vault) Unlock(passphrase string) error {
+	if v.Team() {
+		return errors.New("Team vaults have no passphrase")
+	}
+	k, err := DeriveKey(passphrase, v.kdf)
+	if err != nil {
+		return err
+	}
+	return v.UnlockKey(k)
+}
+
+// UnlockKey decrypts the vault with a key returned by Key. The vault keeps
+// a copy of k.
+func (v *Vault) UnlockKey(k []byte) error {
+	var data []byte
+	if v.hdr.Version == FormatV1 {
+		if len(v.content) < aes.BlockSize {
+			return ErrCorrupted
+		}
+		var err error
+		if data, err = decrypt(v.content[aes.BlockSize:], k, v.content[:aes.BlockSize]); err != nil {
+			return ErrCorrupted
+		}
+	} else {
+		h, payload, err := openFile(v.content, k)
+		if err != nil {
+			return err
+		}
+		v.hdr, data = h, payload
+	}
+
+	p, err := parsePayload(data, v.modified)
+	if err != nil {
+		// v1 has no authentication, a failing unmarshal is the only hint
+		if v.hdr.Version == FormatV1 {
+			return ErrWrongPassword
+		}
+		return fmt.Errorf("File corrupted: %s", err)
+	}
+	if p.Entries != nil {
+		if err := v.loadEntries(p, v.hdr.DataKey); err != nil {
+			return err
+		}
+	}
+	v.key = append([]byte(nil), k...)
+	v.setPayload(p)
+	v.saved = attachmentsOf(p.Keys)
+	return nil
+}
+
+func (v *Vault) payload() *payload {
+	return &payload{Schema: schemaVersion, Keys: v.keys, Log: v.log, Members: v.members, Deleted: v.deleted}
+}
+
+func (v *Vault) setPayload(p *payload) {
+	v.keys, v.log, v.members, v.deleted = p.Keys, p.Log, p.Members, p.Deleted
+	v.unlocked = true
+}
+
+// CheckPassphrase tells whether passphrase is the one of the vault, e.g.
+// when it was unlocked with a cached key.
+func (v *Vault) CheckPassphrase(passphrase string) error {
+	k, err := DeriveKey(passphrase, v.kdf)
+	if err != nil {
+		return err
+	}
+	// v1 files have no key check
+	check := v.hdr.Check
+	if len(check) == 0 {
+		check = keyCheck(v.key)
+	}
+	if !hmac.Equal(keyCheck(k), check) {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// SetPassphrase protects the vault with a new passphrase or new key
+// derivation parameters from the next Save on.
+func (v *Vault) SetPassphrase(passphrase string, p *KDFParams) error {
+	if v.Team() {
+		return errors.New("Team vaults have no passphrase")
+	}
+	k, err := DeriveKey(passphrase, p)
+	if err != nil {
+		return err
+	}
+	v.kdf, v.key = p, k
+	return nil
+}
+
+// RotateKey replaces the data key the keys are encrypted with on the next
+// Save, and the keys of the attachments, see rotateAttachments.
+func (v *Vault) RotateKey() error {
+	if !v.Team() {
+		v.hdr.DataKey = nil
+		return v.rotateAttachments()
+	}
+	k, err := newDataKey()
+	if err != nil {
+		return err
+	}
+	v.key = k
+	return v.rotateAttachments()
+}
+
+// Get returns the key name.
+func (v *Vault) Get(name string) (Key, bool) {
+	k, found := v.keys[name]
+	return k, found
+}
+
+// Put stores k, keeping the creation time and the password history of the
+// key it replaces.
+func (v *Vault) Put(k Key) {
+	now := time.Now()
+	if old, found := v.keys[k.Name]; found {
+		k.Created = old.Created
+		k.History = old.History
+		if old.Password != k.Password {
+			k.History = append(k.History, PasswordChange{old.Password, now})
+		}
+		v.LogOp("update", k.Name)
+	} else {
+		k.Created = now
+		v.LogOp("add", k.Name)
+	}
+	k.Modified = now
+	v.Store(k)
+}
+
+// Store stores k as it is, with its timestamps and history, e.g. to undo a
+// change or to import a key.
+func (v *Vault) Store(k Key) {
+	v.keys[k.Name] = k
+	delete(v.deleted, k.Name)
+}
+
+// Delete removes the key name and reports whether it existed.
+func (v *Vault) Delete(name string) bool {
+	if _, found := v.keys[name]; !found {
+		return false
+	}
+	delete(v.keys, name)
+	if v.deleted == nil {
+		v.deleted = make(map[string]time.Time)
+	}
+	v.deleted[name] = time.Now()
+	v.LogOp("delete", name)
+	return true
+}
+
+// List returns the keys sorted by name.
+func (v *Vault) List() []Key {
+	names := v.Names()
+	list := make([]Key, len(names))
+	for i, name := range names {
+		list[i] = v.keys[name]
+	}
+	return list
+}
+
+// Names returns the names of the keys, sorted.
+func (v *Vault) Names() []string {
+	names := make([]string, 0, len(v.keys))
+	for name := range v.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Len returns the number of keys.
+func (v *Vault) Len() int {
+	return len(v.keys)
+}
+
+// LogOp appends an operation on the key name, if any, to the vault log.
+func (v *Vault) LogOp(op, name string) {
+	v.log = append(v.log, LogRecord{time.Now(), op, name})
+}
+
+// Log returns the vault log, oldest first.
+func (v *Vault) Log() []LogRecord {
+	return v.log
+}
+
+// Save writes the encrypted keys back to the store, unless another process
+// changed the vault since it was opened.
+func (v *Vault) Save() error {
+	if !v.unlocked {
+		return ErrNotUnlocked
+	}
+	if v.store == nil {
+		return errors.New("Vault has no store to save to")
+	}
+	if v.hdr.Version == FormatV1 && v.kdf.KDF == KDFSHA256 {
+		return ErrUpgrade
+	}
+
+	v.hdr.KDF, v.hdr.KDFParams = v.kdf.KDF, v.kdf.marshal()
+	if v.Team() {
+		v.hdr.DataKey = v.key
+	} else if v.hdr.DataKey == nil {
+		k, err := newDataKey()
+		if err != nil {
+			return err
+		}
+		v.hdr.DataKey = k
+	}
+
+	p := v.payload()
+	var written, replaced []string
+	var stored map[string]storedEntry
+	if v.perEntry {
+		var err error
+		if p.Entries, stored, written, replaced, err = v.saveEntries(v.hdr.DataKey); err != nil {
+			return fmt.Errorf("Failed to save %s: %s", v.store, err)
+		}
+		p.Keys = nil
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal: %s", err)
+	}
+
+	if v.Team() {
+		if v.hdr.Wrapped, err = wrapTeamKey(v.key, v.members); err != nil {
+			return fmt.Errorf("Cannot encrypt the data key for the members: %s", err)
+		}
+	}
+
+	content, err := sealFile(v.hdr, data, v.key)
+	if err != nil {
+		return fmt.Errorf("Failed to encrypt: %s", err)
+	}
+
+	version, err := v.store.Put(vaultObject, content, v.version)
+	if err != nil {
+		for _, name := range written {
+			v.store.Delete(name)
+		}
+		v.collectAttachments(false)
+		if err == ErrConflict {
+			return fmt.Errorf("%s was changed by another process since it was loaded, nothing saved", v.store)
+		}
+		return fmt.Errorf("Failed to save %s: %s", v.store, err)
+	}
+	// the vault file no longer points to them
+	for _, name := range replaced {
+		v.store.Delete(name)
+	}
+	v.collectAttachments(true)
+
+	v.version = version
+	if v.perEntry {
+		v.stored, v.entriesKey = stored, append([]byte(nil), v.hdr.DataKey...)
+	}
+	return nil
+}
+
+// Close forgets the keys and wipes the key material from memory.
+func (v *Vault) Close() error {
+	for _, b := range [][]byte{v.key, v.hdr.DataKey, v.entriesKey} {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+	v.key, v.hdr.DataKey, v.entriesKey = nil, nil, nil
+	v.keys, v.log, v.members, v.deleted, v.stored = nil, nil, nil, nil, nil
+	v.saved, v.pending = nil, nil
+	v.unlocked = false
+	return nil
+}
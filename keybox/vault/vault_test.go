@@ -0,0 +1,245 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKDF(t *testing.T) *KDFParams {
+	p, err := NewKDFParams(KDFArgon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keep the test fast
+	p.Time, p.Memory = 1, 64
+	return p
+}
+
+func TestVaultRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault")
+	v, err := Create(NewFileStore(path), testKDF(t), "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Put(Key{Name: "gh", Login: "me", Password: "one"})
+	v.Put(Key{Name: "bank", Login: "12345", Password: "two"})
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create(NewFileStore(path), testKDF(t), "pw"); err == nil {
+		t.Error("created over an existing vault")
+	}
+
+	w, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := w.Get("gh"); found {
+		t.Error("keys readable before Unlock")
+	}
+	if err := w.Save(); err != ErrNotUnlocked {
+		t.Errorf("save before Unlock: got %v, want ErrNotUnlocked", err)
+	}
+	if err := w.Unlock("wrong"); err != ErrWrongPassword {
+		t.Errorf("wrong passphrase: got %v, want ErrWrongPassword", err)
+	}
+	if err := w.Unlock("pw"); err != nil {
+		t.Fatal(err)
+	}
+	if names := w.Names(); len(names) != 2 || names[0] != "bank" {
+		t.Errorf("names %v", names)
+	}
+	if k, _ := w.Get("gh"); k.Password != "one" {
+		t.Errorf("gh %+v", k)
+	}
+
+	// a new passphrase, the cached key no longer opens it
+	old := append([]byte(nil), w.Key()...)
+	if err := w.SetPassphrase("new", testKDF(t)); err != nil {
+		t.Fatal(err)
+	}
+	w.Delete("bank")
+	if err := w.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.CheckPassphrase("new"); err != nil {
+		t.Errorf("CheckPassphrase: %v", err)
+	}
+	w.Close()
+	if _, found := w.Get("gh"); found {
+		t.Error("keys readable after Close")
+	}
+
+	x, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := x.UnlockKey(old); err != ErrWrongPassword {
+		t.Errorf("old key: got %v, want ErrWrongPassword", err)
+	}
+	if err := x.Unlock("new"); err != nil || x.Len() != 1 {
+		t.Fatalf("new passphrase: %v, %d keys", err, x.Len())
+	}
+
+	// the first writer wins, v saved before x was opened
+	if err := v.Save(); err == nil {
+		t.Error("overwrote a vault changed since it was opened")
+	}
+}
+
+func TestSaveUnchanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault")
+	v, err := Create(NewFileStore(path), &KDFParams{KDF: KDFSHA256}, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// created by someone else in the meantime
+	ioutil.WriteFile(path, []byte("theirs"), 0600)
+	if err := v.Save(); err == nil {
+		t.Error("file created since Create not detected")
+	}
+	os.Remove(path)
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Save(); err != nil {
+		t.Errorf("unchanged file: %v", err)
+	}
+
+	os.Remove(path)
+	if err := v.Save(); err == nil {
+		t.Error("removal since open not detected")
+	}
+}
+
+func TestUpgradeV1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vault")
+	key := sha256.Sum256([]byte("pw"))
+	iv := make([]byte, aes.BlockSize)
+	ciphertext, err := encrypt([]byte(`{"gh":{"Name":"gh","Login":"me","Password":"pw"}}`), key[:], iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path, append(iv, ciphertext...), 0600)
+
+	v, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Unlock("pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Save(); err != ErrUpgrade {
+		t.Errorf("save without upgrade: got %v, want ErrUpgrade", err)
+	}
+	if content, _ := ioutil.ReadFile(path); !bytes.Equal(content, v.Content()) {
+		t.Error("v1 file changed")
+	}
+
+	if err := v.SetPassphrase("pw", testKDF(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+	w, err := Open(path)
+	if err != nil || w.Version() != FormatV3 || w.Unlock("pw") != nil {
+		t.Fatalf("upgraded file: version %d, %v", w.Version(), err)
+	}
+	if k, _ := w.Get("gh"); k.Password != "pw" {
+		t.Errorf("gh %+v", k)
+	}
+}
+
+func TestPerEntryVault(t *testing.T) {
+	dir := t.TempDir()
+	objects := func() []string {
+		names, _ := filepath.Glob(filepath.Join(dir, "keys", "*"))
+		return names
+	}
+	open := func() *Vault {
+		v, err := OpenStore(NewDirStore(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := v.Unlock("pw"); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	v, err := Create(NewDirStore(dir), &KDFParams{KDF: KDFSHA256}, "pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Put(Key{Name: "a", Password: "one"})
+	v.Put(Key{Name: "b", Password: "two"})
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+	first := objects()
+	if len(first) != 2 {
+		t.Fatalf("objects %v", first)
+	}
+
+	// only the changed key is written
+	v = open()
+	v.Put(Key{Name: "a", Password: "three"})
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+	second := objects()
+	if len(second) != 2 || contains(second, first) != 1 {
+		t.Errorf("objects %v after %v", second, first)
+	}
+
+	// the first writer wins and the loser leaves nothing behind
+	x, y := open(), open()
+	x.Delete("b")
+	y.Put(Key{Name: "c", Password: "four"})
+	if err := x.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := y.Save(); err == nil {
+		t.Error("second writer overwrote the first")
+	}
+	if got := objects(); len(got) != 1 {
+		t.Errorf("objects %v after a delete and a conflict", got)
+	}
+
+	// a new data key rewrites every key
+	v = open()
+	if k, _ := v.Get("a"); k.Password != "three" || v.Len() != 1 {
+		t.Errorf("reopened with %v", v.List())
+	}
+	before := objects()
+	v.RotateKey()
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if after := objects(); len(after) != 1 || after[0] == before[0] {
+		t.Errorf("objects %v after rotating %v", after, before)
+	}
+	if k, _ := open().Get("a"); k.Password != "three" {
+		t.Errorf("a after rotation: %+v", k)
+	}
+}
+
+// contains counts the elements of sub in list.
+func contains(list, sub []string) int {
+	n := 0
+	for _, s := range sub {
+		for _, l := range list {
+			if l == s {
+				n++
+			}
+		}
+	}
+	return n
+}
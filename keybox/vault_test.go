@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigResolve(t *testing.T) {
+	os.Setenv("KEYBOX_CONFIG", filepath.Join(t.TempDir(), "keybox", "config.json"))
+	defer os.Unsetenv("KEYBOX_CONFIG")
+	defer os.Setenv("KEYBOXFILE", os.Getenv("KEYBOXFILE"))
+	os.Unsetenv("KEYBOXFILE")
+
+	c, err := loadConfig()
+	if err != nil || len(c.Vaults) != 0 {
+		t.Fatalf("missing config: %v, %v", c, err)
+	}
+	if _, err := c.resolve(""); err == nil {
+		t.Error("resolved a vault without any configured")
+	}
+
+	c.Vaults["personal"] = vaultConfig{Path: "/vaults/personal"}
+	c.Vaults["work"] = vaultConfig{Path: "/vaults/work"}
+	c.Current = "work"
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ name, env, want string }{
+		{"", "", "/vaults/work"},
+		{"personal", "", "/vaults/personal"},
+		{"", "/env/vault", "/env/vault"},
+		{"personal", "/env/vault", "/vaults/personal"},
+		{"./other", "", "./other"},
+	} {
+		os.Setenv("KEYBOXFILE", tc.env)
+		if got, err := c.resolve(tc.name); err != nil || got != tc.want {
+			t.Errorf("resolve(%q) with KEYBOXFILE=%q: got %q, %v, want %q", tc.name, tc.env, got, err, tc.want)
+		}
+	}
+
+	if _, err := c.resolve("unknown"); err == nil {
+		t.Error("resolved an unknown vault")
+	}
+}
+
+func TestVaultState(t *testing.T) {
+	useKeys(t, key{Name: "a"})
+	dbpath = "first"
+	first := currentVault()
+
+	openVault("second", "")
+	if dbpath != "second" || db != nil {
+		t.Errorf("openVault left %s with %v", dbpath, db)
+	}
+
+	first.use()
+	if _, found := db.Get("a"); dbpath != "first" || !found {
+		t.Errorf("use restored %s with %v", dbpath, db.Names())
+	}
+}